@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"gosync/conf"
+	"gosync/internal/control"
+	"os"
+	"strings"
+	"time"
+)
+
+const ctlUsage = `Usage: gosync [-config file] [-socket path] <command> [args]
+
+Commands:
+  status [queue]       show the status of sync queues
+  queue list [queue]   list the pending sync tasks
+  full-sync [queue]    schedule a full sync
+  pause [queue]        stop starting new sync tasks
+  resume [queue]       resume the paused queues
+  retry-now [queue]    retry the failed sync tasks without waiting
+  log-level [level]    show or change the log level
+
+queue is the name of a target or target/destination, all queues by default.
+`
+
+// 命令行子命令，通过控制接口操作正在运行的gosync，返回进程的退出码
+func ctl(configFile string, socket string, args []string) int {
+	if socket == "" {
+		config, err := conf.Load(configFile)
+		if err == nil {
+			socket = config.Control.Socket
+		} else if configFile != "" {
+			fmt.Fprintf(os.Stderr, "Load config error: %s\n", err.Error())
+			return 1
+		} else {
+			socket = "/run/gosync.sock"
+		}
+	}
+	if socket == "none" {
+		fmt.Fprintln(os.Stderr, "Control socket is disabled.")
+		return 1
+	}
+	client := control.NewClient(socket)
+
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+	var err error
+	switch args[0] {
+	case "status":
+		var statuses []control.QueueStatus
+		statuses, err = client.Status(arg(1))
+		printStatus(statuses)
+	case "queue":
+		if arg(1) != "list" {
+			fmt.Fprint(os.Stderr, ctlUsage)
+			return 2
+		}
+		var lists []control.QueueList
+		lists, err = client.List(arg(2))
+		for _, list := range lists {
+			fmt.Printf("%s (%d tasks)\n", list.Name, len(list.Actions))
+			for _, action := range list.Actions {
+				fmt.Printf("  %s\n", action)
+			}
+		}
+	case "full-sync", "pause", "resume", "retry-now":
+		var statuses []control.QueueStatus
+		statuses, err = client.Do(args[0], arg(1))
+		printStatus(statuses)
+	case "log-level":
+		var level string
+		level, err = client.LogLevel(arg(1))
+		if err == nil {
+			fmt.Println(level)
+		}
+	default:
+		fmt.Fprint(os.Stderr, ctlUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+func printStatus(statuses []control.QueueStatus) {
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format("2006-01-02 15:04:05")
+	}
+	for _, status := range statuses {
+		state := "running"
+		if status.Paused {
+			state = "paused"
+		}
+		fullSync := "-"
+		if status.FullSyncRunning {
+			fullSync = "running"
+		} else if status.FullSyncPending {
+			fullSync = "pending"
+		}
+		inflight := "-"
+		if len(status.Inflight) > 0 {
+			inflight = strings.Join(status.Inflight, ", ")
+		}
+		fmt.Printf("%s (%s)\n", status.Name, state)
+		fmt.Printf("  queued:       %d\n", status.Queued)
+		fmt.Printf("  inflight:     %s\n", inflight)
+		fmt.Printf("  full sync:    %s\n", fullSync)
+		if !status.OldestUnsynced.IsZero() {
+			fmt.Printf("  oldest:       %s (%s ago)\n", formatTime(status.OldestUnsynced), time.Since(status.OldestUnsynced).Round(time.Second))
+		}
+		if !status.RetryAt.IsZero() {
+			fmt.Printf("  retry at:     %s\n", formatTime(status.RetryAt))
+		}
+		if status.SentFiles > 0 {
+			fmt.Printf("  sent:         %d files, %d bytes\n", status.SentFiles, status.SentBytes)
+		}
+		if status.DeletedFiles > 0 {
+			fmt.Printf("  deleted:      %d files\n", status.DeletedFiles)
+		}
+		fmt.Printf("  last success: %s\n", formatTime(status.LastSuccess))
+		if status.LastError != "" {
+			fmt.Printf("  last failure: %s (%s)\n", formatTime(status.LastFailure), status.LastError)
+		} else {
+			fmt.Printf("  last failure: %s\n", formatTime(status.LastFailure))
+		}
+	}
+}
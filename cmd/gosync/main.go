@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"gosync/conf"
+	"gosync/internal/alert"
+	"gosync/internal/control"
+	"gosync/internal/dest"
 	"gosync/internal/job"
+	"gosync/internal/metrics"
 	"gosync/internal/rsync"
+	"gosync/internal/s3"
 	"gosync/internal/watcher"
 	"log/syslog"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"syscall"
 
 	"github.com/sevlyar/go-daemon"
 	"github.com/sirupsen/logrus"
@@ -34,8 +43,19 @@ func main() {
 	configFile := flag.String("config", "", "configuration file")
 	isDaemon := flag.Bool("daemon", false, "run as a service")
 	showVersion := flag.Bool("version", false, "show version information")
+	socket := flag.String("socket", "", "control socket, used by the commands")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: gosync [options] [command]\n\nOptions:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\n%s", ctlUsage)
+	}
 	flag.Parse()
 
+	// 有子命令时作为客户端操作正在运行的gosync
+	if flag.NArg() > 0 {
+		os.Exit(ctl(*configFile, *socket, flag.Args()))
+	}
+
 	// 显示banner
 	fmt.Print(`     ___    ___                           
     / _ \  /___\  ___  _   _  _ __    ___ 
@@ -70,20 +90,7 @@ func main() {
 	}
 
 	// 初始化日志
-	switch config.Logrus.Level {
-	case "VERBOSE", "TRACE":
-		logrus.SetLevel(logrus.TraceLevel)
-	case "DEBUG":
-		logrus.SetLevel(logrus.DebugLevel)
-	case "INFO":
-		logrus.SetLevel(logrus.InfoLevel)
-	case "WARN":
-		logrus.SetLevel(logrus.WarnLevel)
-	case "ERROR":
-		logrus.SetLevel(logrus.ErrorLevel)
-	case "FATAL":
-		logrus.SetLevel(logrus.FatalLevel)
-	}
+	setLogLevel(config.Logrus.Level)
 	if config.Logrus.Output == "file" {
 		logFile := config.Logrus.File.Path
 		if !filepath.IsAbs(logFile) {
@@ -109,6 +116,7 @@ func main() {
 	}
 
 	// 后台进程
+	release := func() {}
 	if *isDaemon {
 		// 创建一个新的守护进程
 		ctx := &daemon.Context{
@@ -126,33 +134,150 @@ func main() {
 			logrus.Info("GO sync run as a service.")
 			return
 		}
-		defer ctx.Release() // 当程序结束时释放守护进程资源
+		release = func() { ctx.Release() } // 当程序结束时释放守护进程资源
 	}
 
-	// 初始化RemoteSync
-	err = rsync.Init(config)
-	if err != nil {
-		logrus.WithError(err).Fatalf("Initialize rsync error: %s", err.Error())
-		os.Exit(3)
+	// 为每个同步目标的每个远端初始化客户端和同步任务队列
+	queues := map[string][]*watcher.Queue{}
+	for i := range config.Targets {
+		target := &config.Targets[i]
+		for j := range target.Destinations {
+			client, err := newDestination(target, &target.Destinations[j], config.Dir)
+			if err != nil {
+				logrus.WithError(err).Fatalf("Initialize destination %s error: %s", target.Name, err.Error())
+				os.Exit(3)
+			}
+			queue, err := watcher.CreateQueue(&config.Queue, client)
+			if err != nil {
+				logrus.WithError(err).Fatalf("Open journal of %s error: %s", client.Name(), err.Error())
+				os.Exit(3)
+			}
+			queues[target.Name] = append(queues[target.Name], queue)
+		}
 	}
 
-	// 初始化同步任务队列
-	queue := watcher.CreateQueue(&config.Queue)
-
 	// 启动定时任务
-	err = job.Start(config, &queue)
+	err = job.Start(config, queues)
 	if err != nil {
 		logrus.WithError(err).Fatalf("Start scheduled job error: %s", err.Error())
 		os.Exit(4)
 	}
-	defer job.Stop()
 
-	// 初始化并启动监听
-	err = watcher.Start(&config.Rsync, &queue)
-	if err != nil {
-		logrus.WithError(err).Fatalf("Start watcher error: %s", err.Error())
-		os.Exit(5)
+	// 启动控制接口，启动失败不影响同步
+	var server *control.Server
+	if config.Control.Socket != "none" {
+		server, err = control.Start(config.Control.Socket, queues, setLogLevel)
+		if err != nil {
+			logrus.WithError(err).Errorf("Start control socket error: %s", err.Error())
+		}
+	}
+
+	// 启动指标服务，未配置listen时不启用
+	var metricsServer *http.Server
+	if config.Metrics.Listen != "" {
+		metricsServer, err = metrics.Start(config.Metrics.Listen)
+		if err != nil {
+			logrus.WithError(err).Errorf("Start metrics server error: %s", err.Error())
+		}
+	}
+
+	// 初始化并启动监听，每个同步目标运行在独立的协程中
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, len(config.Targets))
+	for i := range config.Targets {
+		target := &config.Targets[i]
+		qs := queues[target.Name]
+		go func() {
+			errs <- watcher.Start(ctx, target, config.Dir, qs)
+		}()
+	}
+
+	// 监控复制延迟
+	sources := []alert.Source{}
+	for _, qs := range queues {
+		for _, queue := range qs {
+			sources = append(sources, queue)
+		}
+	}
+	alert.Reload(&config.Alert, config.Dir)
+	go alert.Start(ctx, sources)
+
+	// 收到SIGHUP时重新加载配置文件，收到SIGTERM或SIGINT时停止监听并等待队列排空
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	for running := len(config.Targets); running > 0; {
+		select {
+		case <-hup:
+			config = reload(config, queues)
+		case sig := <-term:
+			logrus.Infof("Received %s, shutting down ...", sig)
+			cancel()
+			// 再次收到信号时不再等待
+			signal.Reset(syscall.SIGTERM, syscall.SIGINT)
+		case err = <-errs:
+			if err != nil {
+				logrus.WithError(err).Fatalf("Start watcher error: %s", err.Error())
+				os.Exit(5)
+			}
+			running--
+		}
+	}
+	cancel()
+
+	job.Stop()
+	remaining := 0
+	for _, qs := range queues {
+		for _, queue := range qs {
+			remaining += queue.Wait()
+			// 关闭队列时同时清理rsync客户端的临时文件
+			queue.Close()
+		}
+	}
+	server.Close()
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+	release()
+	if remaining == 0 {
+		logrus.Info("GO sync stopped.")
+		return
+	}
+	if config.Queue.StateDir != "" {
+		logrus.Warnf("GO sync stopped with %d sync tasks saved to %s.", remaining, config.Queue.StateDir)
+		return
+	}
+	logrus.Errorf("GO sync stopped with %d sync tasks lost.", remaining)
+	os.Exit(7)
+}
+
+// 按传输方式创建远端的客户端
+func newDestination(c *conf.RsyncConfig, d *conf.DestinationConfig, workdir string) (dest.Destination, error) {
+	if d.Transport == "s3" {
+		return s3.New(c, d, workdir)
+	}
+	return rsync.New(c, d, workdir)
+}
+
+func setLogLevel(level string) bool {
+	switch level {
+	case "VERBOSE", "TRACE":
+		logrus.SetLevel(logrus.TraceLevel)
+	case "DEBUG":
+		logrus.SetLevel(logrus.DebugLevel)
+	case "INFO":
+		logrus.SetLevel(logrus.InfoLevel)
+	case "WARN", "WARNING":
+		logrus.SetLevel(logrus.WarnLevel)
+	case "ERROR":
+		logrus.SetLevel(logrus.ErrorLevel)
+	case "FATAL":
+		logrus.SetLevel(logrus.FatalLevel)
+	default:
+		return false
 	}
+	return true
 }
 
 type LogFormatter struct{}
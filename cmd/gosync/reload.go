@@ -0,0 +1,66 @@
+package main
+
+import (
+	"gosync/conf"
+	"gosync/internal/alert"
+	"gosync/internal/dest"
+	"gosync/internal/job"
+	"gosync/internal/watcher"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 重新加载配置文件并使能够在运行中生效的配置立即生效，返回生效后的配置。
+// 新的配置无效时保留原来的配置，需要重启才能生效的变更会输出警告。
+func reload(config *conf.Config, queues map[string][]*watcher.Queue) *conf.Config {
+	logrus.Infof("Reloading config %s ...", config.File)
+	newConfig, ignored, err := conf.Reload(config)
+	if err != nil {
+		logrus.WithError(err).Errorf("Reload config error, keep the current config: %s", err.Error())
+		return config
+	}
+
+	// 先创建新的远端客户端和定时任务，失败时不做任何变更
+	clients := map[string][]dest.Destination{}
+	closeClients := func() {
+		for _, cs := range clients {
+			for _, client := range cs {
+				client.Close()
+			}
+		}
+	}
+	for i := range newConfig.Targets {
+		target := &newConfig.Targets[i]
+		for j := range target.Destinations {
+			client, err := newDestination(target, &target.Destinations[j], newConfig.Dir)
+			if err != nil {
+				closeClients()
+				logrus.WithError(err).Errorf("Initialize destination %s error, keep the current config: %s", target.Name, err.Error())
+				return config
+			}
+			clients[target.Name] = append(clients[target.Name], client)
+		}
+	}
+	err = job.Reload(newConfig)
+	if err != nil {
+		closeClients()
+		logrus.WithError(err).Errorf("Reload scheduled job error, keep the current config: %s", err.Error())
+		return config
+	}
+
+	setLogLevel(newConfig.Logrus.Level)
+	alert.Reload(&newConfig.Alert, newConfig.Dir)
+	for i := range newConfig.Targets {
+		target := &newConfig.Targets[i]
+		watcher.Reload(target)
+		for j, queue := range queues[target.Name] {
+			queue.SetConfig(&newConfig.Queue)
+			queue.SetClient(clients[target.Name][j])
+		}
+	}
+	for _, key := range ignored {
+		logrus.Warnf("Config %s changed, restart gosync to take effect.", key)
+	}
+	logrus.Info("Config reloaded.")
+	return newConfig
+}
@@ -2,8 +2,10 @@ package conf
 
 import (
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"time"
 
@@ -25,37 +27,113 @@ type LogFileConfig struct {
 }
 
 type RsyncConfig struct {
-	Host           string   `yaml:"host"`
-	Port           int      `yaml:"port"`
-	Username       string   `yaml:"username"`
-	Password       string   `yaml:"password"`
-	Timeout        string   `yaml:"timeout"`
-	IOTimeout      string   `yaml:"io-timeout"`
-	Space          string   `yaml:"space"`
+	Name string `yaml:"name"`
+	// 只有一个远端时直接配置在同步目标上，配置了destinations时作为各个远端的默认值
+	RemoteConfig   `yaml:",inline"`
 	RootPath       string   `yaml:"root-path"`
 	WatchScopeEval string   `yaml:"watch-scope-eval"`
+	Watcher        string   `yaml:"watcher"`
+	FanotifyMark   string   `yaml:"fanotify-mark"`
+	ScanInterval   string   `yaml:"scan-interval"`
+	Symlinks       string   `yaml:"symlinks"`
 	Compress       bool     `yaml:"compress"`
+	Xattrs         bool     `yaml:"xattrs"`
+	Acls           bool     `yaml:"acls"`
 	AllowDelete    bool     `yaml:"allow-delete"`
 	FullSync       string   `yaml:"full-sync"`
 	Excludes       []string `yaml:"excludes"`
+	// 同一个目录可以推送到多个远端，未配置时使用上面的host等配置作为唯一的远端
+	Destinations []DestinationConfig `yaml:"destinations"`
+}
+
+type DestinationConfig struct {
+	Name         string `yaml:"name"`
+	RemoteConfig `yaml:",inline"`
+}
+
+// 远端的连接配置
+type RemoteConfig struct {
+	Host      string `yaml:"host"`
+	Port      int    `yaml:"port"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+	Timeout   string `yaml:"timeout"`
+	IOTimeout string `yaml:"io-timeout"`
+	Space     string `yaml:"space"`
+	// rsyncd(默认)、ssh、local或s3，ssh时使用identity-file、known-hosts和remote-path，local时remote-path为本地目录，
+	// s3时使用endpoint、bucket等配置，remote-path为对象名的前缀
+	Transport string `yaml:"transport"`
+	// rsync(默认)调用rsync命令，native使用内置的rsync协议实现，只支持rsyncd
+	Engine       string `yaml:"engine"`
+	IdentityFile string `yaml:"identity-file"`
+	KnownHosts   string `yaml:"known-hosts"`
+	RemotePath   string `yaml:"remote-path"`
+	Endpoint     string `yaml:"endpoint"`
+	Bucket       string `yaml:"bucket"`
+	Region       string `yaml:"region"`
+	AccessKey    string `yaml:"access-key"`
+	SecretKey    string `yaml:"secret-key"`
+	// 分片上传的分片大小(M)，不超过分片大小的文件直接上传
+	PartSize int `yaml:"part-size"`
+}
+
+// 未配置的项取defaults中的值
+func (remote *RemoteConfig) inherit(defaults *RemoteConfig) {
+	v, d := reflect.ValueOf(remote).Elem(), reflect.ValueOf(defaults).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() {
+			v.Field(i).Set(d.Field(i))
+		}
+	}
 }
 
 type QueueConfig struct {
 	RetryInterval string `yaml:"retry-interval"`
 	Capacity      int    `yaml:"capacity"`
+	StateDir      string `yaml:"state-dir"`
+	Workers       int    `yaml:"workers"`
+	DrainTimeout  string `yaml:"drain-timeout"`
+}
+
+type ControlConfig struct {
+	Socket string `yaml:"socket"`
+}
+
+type MetricsConfig struct {
+	Listen string `yaml:"listen"`
+}
+
+type AlertConfig struct {
+	MaxLag    string           `yaml:"max-lag"`
+	Interval  string           `yaml:"interval"`
+	Notifiers []NotifierConfig `yaml:"notifiers"`
+}
+
+type NotifierConfig struct {
+	Type    string `yaml:"type"`
+	Command string `yaml:"command"`
+	URL     string `yaml:"url"`
+	Timeout string `yaml:"timeout"`
 }
 
 type JobConfig struct {
+	Name    string `yaml:"name"`
 	Cron    string `yaml:"cron"`
 	Command string `yarm:"command"`
+	Target  string `yaml:"target"`
 }
 
 type Config struct {
-	Dir    string
-	Logrus LogrusConfig `yaml:"log"`
-	Rsync  RsyncConfig  `yaml:"rsync"`
-	Queue  QueueConfig  `yaml:"queue"`
-	Jobs   []JobConfig  `yaml:"jobs"`
+	File    string
+	Dir     string
+	Logrus  LogrusConfig  `yaml:"log"`
+	Rsync   RsyncConfig   `yaml:"rsync"`
+	Targets []RsyncConfig `yaml:"targets"`
+	Queue   QueueConfig   `yaml:"queue"`
+	Control ControlConfig `yaml:"control"`
+	Metrics MetricsConfig `yaml:"metrics"`
+	Alert   AlertConfig   `yaml:"alert"`
+	Jobs    []JobConfig   `yaml:"jobs"`
 }
 
 func Load(filename string) (*Config, error) {
@@ -99,6 +177,7 @@ func Load(filename string) (*Config, error) {
 		return nil, err
 	}
 
+	config.File = configFile
 	config.Dir = filepath.Dir(configFile)
 	if config.Logrus.Level == "" {
 		config.Logrus.Level = "INFO"
@@ -118,34 +197,31 @@ func Load(filename string) (*Config, error) {
 			}
 		}
 	}
-	if config.Rsync.Host == "" {
-		return nil, fmt.Errorf("rsync.host is null")
-	}
-	if config.Rsync.Username == "" {
-		return nil, fmt.Errorf("rsync.username is null")
-	}
-	if config.Rsync.Timeout != "" {
-		_, err := time.ParseDuration(config.Rsync.Timeout)
-		if err != nil {
-			return nil, fmt.Errorf("rsync.timeout format is invalid")
+	// 兼容只配置了单个rsync的写法
+	legacy := len(config.Targets) == 0
+	if legacy {
+		if config.Rsync.Name == "" {
+			config.Rsync.Name = "default"
 		}
+		config.Targets = []RsyncConfig{config.Rsync}
 	}
-	if config.Rsync.Space == "" {
-		return nil, fmt.Errorf("rsync.space is null")
-	}
-	if config.Rsync.RootPath == "" {
-		return nil, fmt.Errorf("rsync.root-path is null")
-	} else if !strings.HasPrefix(config.Rsync.RootPath, "/") {
-		return nil, fmt.Errorf("rsync.root-path must be a absolute path")
-	} else if !strings.HasSuffix(config.Rsync.RootPath, "/") {
-		config.Rsync.RootPath += "/"
-	}
-	if config.Rsync.FullSync == "" {
-		config.Rsync.FullSync = "startup"
-	} else {
-		config.Rsync.FullSync = strings.ToLower(config.Rsync.FullSync)
-		if config.Rsync.FullSync == "false" {
-			config.Rsync.FullSync = "none"
+	names := map[string]bool{}
+	for i := range config.Targets {
+		target := &config.Targets[i]
+		prefix := "rsync"
+		if !legacy {
+			prefix = fmt.Sprintf("targets[%d]", i)
+			if target.Name == "" {
+				return nil, fmt.Errorf("%s.name is null", prefix)
+			}
+		}
+		if names[target.Name] {
+			return nil, fmt.Errorf("%s.name %s is duplicated", prefix, target.Name)
+		}
+		names[target.Name] = true
+		err := checkRsync(prefix, target)
+		if err != nil {
+			return nil, err
 		}
 	}
 	if config.Queue.RetryInterval == "" {
@@ -161,6 +237,38 @@ func Load(filename string) (*Config, error) {
 	} else if config.Queue.Capacity < 0 {
 		return nil, fmt.Errorf("queue.capacity must be positive")
 	}
+	if config.Queue.Workers == 0 {
+		config.Queue.Workers = 1
+	} else if config.Queue.Workers < 0 {
+		return nil, fmt.Errorf("queue.workers must be positive")
+	}
+	if config.Queue.DrainTimeout == "" {
+		config.Queue.DrainTimeout = "10s"
+	} else {
+		timeout, err := time.ParseDuration(config.Queue.DrainTimeout)
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("queue.drain-timeout format is invalid")
+		}
+	}
+	if config.Queue.StateDir != "" && !filepath.IsAbs(config.Queue.StateDir) {
+		config.Queue.StateDir = filepath.Join(config.Dir, config.Queue.StateDir)
+	}
+	for _, target := range config.Targets {
+		// 文件清单保存在state-dir中
+		if target.FullSync == "reconcile" && config.Queue.StateDir == "" {
+			return nil, fmt.Errorf("queue.state-dir is required when full-sync is reconcile")
+		}
+	}
+	// 控制接口的socket，配置为none时不启用
+	if config.Control.Socket == "" {
+		config.Control.Socket = "/run/gosync.sock"
+	} else if config.Control.Socket != "none" && !filepath.IsAbs(config.Control.Socket) {
+		config.Control.Socket = filepath.Join(config.Dir, config.Control.Socket)
+	}
+	err = checkAlert(&config.Alert)
+	if err != nil {
+		return nil, err
+	}
 	for _, job := range config.Jobs {
 		if job.Cron == "" {
 			return nil, fmt.Errorf("job.cron is null")
@@ -168,11 +276,212 @@ func Load(filename string) (*Config, error) {
 		if job.Command == "" {
 			return nil, fmt.Errorf("job.command is null")
 		}
+		if job.Target != "" && config.GetTarget(job.Target) == nil {
+			return nil, fmt.Errorf("job.target %s not found", job.Target)
+		}
 	}
 
 	return &config, nil
 }
 
+func checkRsync(prefix string, c *RsyncConfig) error {
+	if len(c.Destinations) == 0 {
+		c.Destinations = []DestinationConfig{{}}
+	}
+	names := map[string]bool{}
+	for i := range c.Destinations {
+		dest := &c.Destinations[i]
+		destPrefix := prefix
+		if len(c.Destinations) > 1 {
+			destPrefix = fmt.Sprintf("%s.destinations[%d]", prefix, i)
+			if dest.Name == "" {
+				return fmt.Errorf("%s.name is null", destPrefix)
+			}
+			if names[dest.Name] {
+				return fmt.Errorf("%s.name %s is duplicated", destPrefix, dest.Name)
+			}
+			names[dest.Name] = true
+		}
+		err := checkDestination(destPrefix, c, dest)
+		if err != nil {
+			return err
+		}
+	}
+	if c.RootPath == "" {
+		return fmt.Errorf("%s.root-path is null", prefix)
+	} else if !strings.HasPrefix(c.RootPath, "/") {
+		return fmt.Errorf("%s.root-path must be a absolute path", prefix)
+	} else if !strings.HasSuffix(c.RootPath, "/") {
+		c.RootPath += "/"
+	}
+	if c.Watcher == "" {
+		c.Watcher = "inotify"
+	} else {
+		c.Watcher = strings.ToLower(c.Watcher)
+		if c.Watcher != "inotify" && c.Watcher != "fanotify" && c.Watcher != "poll" {
+			return fmt.Errorf("%s.watcher must be inotify fanotify or poll", prefix)
+		}
+	}
+	if c.ScanInterval == "" {
+		c.ScanInterval = "60s"
+	} else {
+		interval, err := time.ParseDuration(c.ScanInterval)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("%s.scan-interval format is invalid", prefix)
+		}
+	}
+	if c.Symlinks == "" {
+		c.Symlinks = "copy"
+	} else {
+		c.Symlinks = strings.ToLower(c.Symlinks)
+		if c.Symlinks != "copy" && c.Symlinks != "follow" && c.Symlinks != "skip" {
+			return fmt.Errorf("%s.symlinks must be copy follow or skip", prefix)
+		}
+	}
+	if c.FanotifyMark == "" {
+		c.FanotifyMark = "filesystem"
+	} else {
+		c.FanotifyMark = strings.ToLower(c.FanotifyMark)
+		if c.FanotifyMark != "filesystem" && c.FanotifyMark != "mount" {
+			return fmt.Errorf("%s.fanotify-mark must be filesystem or mount", prefix)
+		}
+	}
+	if c.FullSync == "" {
+		c.FullSync = "startup"
+	} else {
+		c.FullSync = strings.ToLower(c.FullSync)
+		if c.FullSync == "false" {
+			c.FullSync = "none"
+		}
+	}
+	return nil
+}
+
+// 远端未配置的项继承同步目标上的配置
+func checkDestination(prefix string, c *RsyncConfig, d *DestinationConfig) error {
+	d.inherit(&c.RemoteConfig)
+	if d.Transport == "" {
+		d.Transport = "rsyncd"
+	} else {
+		d.Transport = strings.ToLower(d.Transport)
+	}
+	// 本地目录不需要连接远端，对象存储使用endpoint
+	if d.Transport == "rsyncd" || d.Transport == "ssh" {
+		if d.Host == "" {
+			return fmt.Errorf("%s.host is null", prefix)
+		}
+		if d.Username == "" {
+			return fmt.Errorf("%s.username is null", prefix)
+		}
+	}
+	if d.Timeout != "" {
+		_, err := time.ParseDuration(d.Timeout)
+		if err != nil {
+			return fmt.Errorf("%s.timeout format is invalid", prefix)
+		}
+	}
+	if d.IOTimeout != "" {
+		_, err := time.ParseDuration(d.IOTimeout)
+		if err != nil {
+			return fmt.Errorf("%s.io-timeout format is invalid", prefix)
+		}
+	}
+	switch d.Transport {
+	case "rsyncd":
+		if d.Space == "" {
+			return fmt.Errorf("%s.space is null", prefix)
+		}
+	case "ssh":
+		if d.RemotePath == "" {
+			return fmt.Errorf("%s.remote-path is null", prefix)
+		} else if !strings.HasSuffix(d.RemotePath, "/") {
+			d.RemotePath += "/"
+		}
+	case "local":
+		if !filepath.IsAbs(d.RemotePath) {
+			return fmt.Errorf("%s.remote-path must be a absolute path", prefix)
+		} else if !strings.HasSuffix(d.RemotePath, "/") {
+			d.RemotePath += "/"
+		}
+		// 目标目录在同步目录内会不断产生新的变更
+		root := strings.TrimSuffix(c.RootPath, "/") + "/"
+		if c.RootPath != "" && (strings.HasPrefix(d.RemotePath, root) || strings.HasPrefix(root, d.RemotePath)) {
+			return fmt.Errorf("%s.remote-path must not overlap root-path", prefix)
+		}
+	case "s3":
+		err := checkS3(prefix, c, d)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s.transport must be rsyncd ssh local or s3", prefix)
+	}
+	if d.Engine == "" {
+		d.Engine = "rsync"
+	} else {
+		d.Engine = strings.ToLower(d.Engine)
+	}
+	switch d.Engine {
+	case "rsync":
+	case "native":
+		if d.Transport != "rsyncd" {
+			return fmt.Errorf("%s.engine native only supports rsyncd transport", prefix)
+		}
+		if c.Xattrs || c.Acls {
+			return fmt.Errorf("%s.engine native does not support xattrs or acls", prefix)
+		}
+	default:
+		return fmt.Errorf("%s.engine must be rsync or native", prefix)
+	}
+	return nil
+}
+
+// 对象存储使用path-style访问bucket，remote-path为对象名的前缀
+func checkS3(prefix string, c *RsyncConfig, d *DestinationConfig) error {
+	if d.Endpoint == "" {
+		return fmt.Errorf("%s.endpoint is null", prefix)
+	}
+	endpoint, err := url.Parse(d.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("%s.endpoint must be a http or https url", prefix)
+	}
+	if d.Bucket == "" {
+		return fmt.Errorf("%s.bucket is null", prefix)
+	}
+	if d.AccessKey == "" {
+		return fmt.Errorf("%s.access-key is null", prefix)
+	}
+	if d.SecretKey == "" {
+		return fmt.Errorf("%s.secret-key is null", prefix)
+	}
+	if d.Region == "" {
+		d.Region = "us-east-1"
+	}
+	// 分片最小5M，最多10000个分片
+	if d.PartSize == 0 {
+		d.PartSize = 16
+	} else if d.PartSize < 5 || d.PartSize > 5120 {
+		return fmt.Errorf("%s.part-size must be between 5 and 5120", prefix)
+	}
+	d.RemotePath = strings.TrimPrefix(d.RemotePath, "/")
+	if d.RemotePath != "" && !strings.HasSuffix(d.RemotePath, "/") {
+		d.RemotePath += "/"
+	}
+	if c.Xattrs || c.Acls {
+		return fmt.Errorf("%s.transport s3 does not support xattrs or acls", prefix)
+	}
+	return nil
+}
+
+func (config *Config) GetTarget(name string) *RsyncConfig {
+	for i := range config.Targets {
+		if config.Targets[i].Name == name {
+			return &config.Targets[i]
+		}
+	}
+	return nil
+}
+
 func find(path string, name string) string {
 	if !strings.HasSuffix(path, "/") {
 		path += "/"
@@ -197,3 +506,51 @@ func find(path string, name string) string {
 	}
 	return ""
 }
+
+func checkAlert(config *AlertConfig) error {
+	if config.MaxLag != "" {
+		lag, err := time.ParseDuration(config.MaxLag)
+		if err != nil || lag <= 0 {
+			return fmt.Errorf("alert.max-lag format is invalid")
+		}
+	}
+	if config.Interval == "" {
+		config.Interval = "10s"
+	} else {
+		interval, err := time.ParseDuration(config.Interval)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("alert.interval format is invalid")
+		}
+	}
+	// 未配置通知方式时输出到日志
+	if len(config.Notifiers) == 0 {
+		config.Notifiers = []NotifierConfig{{Type: "log"}}
+	}
+	for i := range config.Notifiers {
+		notifier := &config.Notifiers[i]
+		prefix := fmt.Sprintf("alert.notifiers[%d]", i)
+		notifier.Type = strings.ToLower(notifier.Type)
+		switch notifier.Type {
+		case "log":
+		case "command":
+			if notifier.Command == "" {
+				return fmt.Errorf("%s.command is null", prefix)
+			}
+		case "webhook":
+			if notifier.URL == "" {
+				return fmt.Errorf("%s.url is null", prefix)
+			}
+		default:
+			return fmt.Errorf("%s.type must be log command or webhook", prefix)
+		}
+		if notifier.Timeout == "" {
+			notifier.Timeout = "10s"
+		} else {
+			timeout, err := time.ParseDuration(notifier.Timeout)
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("%s.timeout format is invalid", prefix)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func load(t *testing.T, content string) (*Config, error) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "gosync.yml")
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return Load(file)
+}
+
+func TestLoadLegacyRsync(t *testing.T) {
+	config, err := load(t, `
+rsync:
+  host: 10.0.0.1
+  port: 873
+  username: backup
+  password: secret
+  space: data
+  root-path: /data
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Targets) != 1 || len(config.Targets[0].Destinations) != 1 {
+		t.Fatalf("targets = %+v", config.Targets)
+	}
+	target := config.Targets[0]
+	if target.Name != "default" || target.RootPath != "/data/" {
+		t.Errorf("target = %+v", target)
+	}
+	dest := target.Destinations[0]
+	want := RemoteConfig{Host: "10.0.0.1", Port: 873, Username: "backup", Password: "secret", Space: "data", Transport: "rsyncd", Engine: "rsync"}
+	if dest.RemoteConfig != want {
+		t.Errorf("destination = %+v, want %+v", dest.RemoteConfig, want)
+	}
+}
+
+func TestLoadDestinationsInherit(t *testing.T) {
+	config, err := load(t, `
+targets:
+  - name: logs
+    host: 10.0.0.1
+    username: backup
+    space: logs
+    root-path: /var/log/
+    destinations:
+      - name: primary
+      - name: dr
+        host: 10.0.0.2
+        transport: ssh
+        remote-path: /backup/logs
+      - name: archive
+        transport: s3
+        endpoint: https://s3.example.com
+        bucket: logs
+        access-key: ak
+        secret-key: sk
+        remote-path: /logs
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dests := config.Targets[0].Destinations
+	if dests[0].Host != "10.0.0.1" || dests[0].Space != "logs" || dests[0].Transport != "rsyncd" {
+		t.Errorf("primary = %+v", dests[0])
+	}
+	if dests[1].Host != "10.0.0.2" || dests[1].Username != "backup" || dests[1].RemotePath != "/backup/logs/" {
+		t.Errorf("dr = %+v", dests[1])
+	}
+	if dests[2].RemotePath != "logs/" || dests[2].Region != "us-east-1" || dests[2].PartSize != 16 {
+		t.Errorf("archive = %+v", dests[2])
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{"rsync:\n  host: h\n  username: u\n  root-path: /data\n", "rsync.space is null"},
+		{"rsync:\n  transport: local\n  remote-path: /data/backup\n  root-path: /data\n", "rsync.remote-path must not overlap root-path"},
+		{"targets:\n  - name: a\n    root-path: /data\n    destinations:\n      - name: x\n        transport: ftp\n      - name: y\n", "targets[0].destinations[0].transport must be rsyncd ssh local or s3"},
+		{"rsync:\n  transport: s3\n  endpoint: https://s3\n  bucket: b\n  access-key: a\n  secret-key: s\n  part-size: 2\n  root-path: /data\n", "rsync.part-size must be between 5 and 5120"},
+	}
+	for _, test := range tests {
+		_, err := load(t, test.content)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("load(%q) error = %v, want %q", test.content, err, test.err)
+		}
+	}
+}
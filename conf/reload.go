@@ -0,0 +1,78 @@
+package conf
+
+import "fmt"
+
+// 重新加载配置文件，新的配置无效时返回错误。
+// 需要重启才能生效的配置项保留原来的值，返回的列表说明哪些变更被忽略了。
+func Reload(old *Config) (*Config, []string, error) {
+	config, err := Load(old.File)
+	if err != nil {
+		return nil, nil, err
+	}
+	ignored := []string{}
+	check := func(key string, changed bool) {
+		if changed {
+			ignored = append(ignored, key)
+		}
+	}
+
+	check("log.output", config.Logrus.Output != old.Logrus.Output || config.Logrus.File != old.Logrus.File)
+	config.Logrus.Output, config.Logrus.File = old.Logrus.Output, old.Logrus.File
+	check("queue.workers", config.Queue.Workers != old.Queue.Workers)
+	config.Queue.Workers = old.Queue.Workers
+	check("queue.state-dir", config.Queue.StateDir != old.Queue.StateDir)
+	config.Queue.StateDir = old.Queue.StateDir
+	check("control.socket", config.Control.Socket != old.Control.Socket)
+	config.Control.Socket = old.Control.Socket
+	check("metrics.listen", config.Metrics.Listen != old.Metrics.Listen)
+	config.Metrics.Listen = old.Metrics.Listen
+
+	// 同步目标的增减需要重启，监听相关的配置也需要重启
+	targets := make([]RsyncConfig, 0, len(old.Targets))
+	for i := range old.Targets {
+		o := &old.Targets[i]
+		n := config.GetTarget(o.Name)
+		if n == nil {
+			ignored = append(ignored, fmt.Sprintf("target %s removed", o.Name))
+			targets = append(targets, *o)
+			continue
+		}
+		target := *n
+		check(o.Name+".root-path", target.RootPath != o.RootPath)
+		target.RootPath = o.RootPath
+		check(o.Name+".watch-scope-eval", target.WatchScopeEval != o.WatchScopeEval)
+		target.WatchScopeEval = o.WatchScopeEval
+		check(o.Name+".watcher", target.Watcher != o.Watcher)
+		target.Watcher = o.Watcher
+		check(o.Name+".fanotify-mark", target.FanotifyMark != o.FanotifyMark)
+		target.FanotifyMark = o.FanotifyMark
+		check(o.Name+".symlinks", target.Symlinks != o.Symlinks)
+		target.Symlinks = o.Symlinks
+		// cron表达式之间的修改通过定时任务生效，启动时的执行方式需要重启
+		if target.FullSync != o.FullSync && (!isCron(target.FullSync) || !isCron(o.FullSync)) {
+			ignored = append(ignored, o.Name+".full-sync")
+			target.FullSync = o.FullSync
+		}
+		// 远端的增减需要重启，远端的连接和认证信息可以直接生效
+		changed := len(target.Destinations) != len(o.Destinations)
+		for j := 0; !changed && j < len(o.Destinations); j++ {
+			changed = target.Destinations[j].Name != o.Destinations[j].Name
+		}
+		check(o.Name+".destinations", changed)
+		if changed {
+			target.Destinations = o.Destinations
+		}
+		targets = append(targets, target)
+	}
+	for _, target := range config.Targets {
+		if old.GetTarget(target.Name) == nil {
+			ignored = append(ignored, fmt.Sprintf("target %s added", target.Name))
+		}
+	}
+	config.Targets = targets
+	return config, ignored, nil
+}
+
+func isCron(fullSync string) bool {
+	return fullSync != "startup" && fullSync != "reconcile" && fullSync != "none"
+}
@@ -0,0 +1,84 @@
+package alert
+
+import (
+	"context"
+	"gosync/conf"
+	"gosync/internal/metrics"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 被监控的同步队列
+type Source interface {
+	Name() string
+	OldestUnsynced() time.Time
+	TakeMaxLatency() time.Duration
+}
+
+type settings struct {
+	config    *conf.AlertConfig
+	notifiers []Notifier
+}
+
+var current atomic.Pointer[settings]
+
+// 设置告警参数和通知方式，重新加载配置后再次调用
+func Reload(config *conf.AlertConfig, workdir string) {
+	s := &settings{config: config}
+	for i := range config.Notifiers {
+		s.notifiers = append(s.notifiers, NewNotifier(&config.Notifiers[i], workdir))
+	}
+	current.Store(s)
+}
+
+// 定期检查每个队列最早的未同步变更和同步完成的变更的最大延迟，超过max-lag时告警，直到ctx被取消。
+// 未配置max-lag时只更新指标。启动前需要先调用Reload设置告警参数。
+func Start(ctx context.Context, sources []Source) {
+	firing := map[string]bool{}
+	for {
+		s := current.Load()
+		interval, _ := time.ParseDuration(s.config.Interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		s = current.Load()
+		maxLag, _ := time.ParseDuration(s.config.MaxLag)
+		now := time.Now()
+		for _, source := range sources {
+			name := source.Name()
+			oldest := source.OldestUnsynced()
+			lag := time.Duration(0)
+			if !oldest.IsZero() {
+				lag = now.Sub(oldest)
+			}
+			metrics.OldestUnsyncedAge.Set(lag.Seconds(), name)
+			// 两次检查之间完成的变更的延迟
+			lag = max(lag, source.TakeMaxLatency())
+			if maxLag <= 0 {
+				firing[name] = false
+				continue
+			}
+			alert := Alert{Queue: name, Lag: lag, MaxLag: maxLag, Oldest: oldest, Time: now}
+			if lag > maxLag && !firing[name] {
+				firing[name] = true
+				alert.State = Firing
+				metrics.LagAlerts.Inc(name)
+			} else if lag <= maxLag && firing[name] {
+				firing[name] = false
+				alert.State = Resolved
+			} else {
+				continue
+			}
+			for _, notifier := range s.notifiers {
+				err := notifier.Notify(ctx, alert)
+				if err != nil {
+					logrus.WithError(err).Errorf("Send %s alert of %s failed: %s", alert.State, name, err.Error())
+				}
+			}
+		}
+	}
+}
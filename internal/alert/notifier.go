@@ -0,0 +1,136 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gosync/conf"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	Firing   = "firing"
+	Resolved = "resolved"
+)
+
+// 复制延迟的告警，Lag超过MaxLag时触发，恢复到MaxLag以内时解除
+type Alert struct {
+	Queue  string
+	State  string
+	Lag    time.Duration
+	MaxLag time.Duration
+	Oldest time.Time
+	Time   time.Time
+}
+
+// 告警的通知方式
+type Notifier interface {
+	Notify(ctx context.Context, alert Alert) error
+}
+
+func NewNotifier(config *conf.NotifierConfig, workdir string) Notifier {
+	timeout, _ := time.ParseDuration(config.Timeout)
+	switch config.Type {
+	case "command":
+		return &commandNotifier{command: config.Command, workdir: workdir, timeout: timeout}
+	case "webhook":
+		return &webhookNotifier{url: config.URL, client: &http.Client{Timeout: timeout}}
+	}
+	return logNotifier{}
+}
+
+type logNotifier struct{}
+
+func (logNotifier) Notify(ctx context.Context, alert Alert) error {
+	if alert.State == Firing {
+		logrus.Errorf("Replication lag of %s is %s, exceeds %s.", alert.Queue, alert.Lag.Round(time.Second), alert.MaxLag)
+	} else {
+		logrus.Infof("Replication lag of %s is back to %s.", alert.Queue, alert.Lag.Round(time.Second))
+	}
+	return nil
+}
+
+// 执行命令，告警信息通过GOSYNC_ALERT_*环境变量传递，运行的工作目录为配置文件所在目录
+type commandNotifier struct {
+	command string
+	workdir string
+	timeout time.Duration
+}
+
+func (notifier *commandNotifier) Notify(ctx context.Context, alert Alert) error {
+	ctx, cancel := context.WithTimeout(ctx, notifier.timeout)
+	defer cancel()
+	args := strings.Split(notifier.command, " ")
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = notifier.workdir
+	cmd.Env = append(os.Environ(),
+		"GOSYNC_ALERT_QUEUE="+alert.Queue,
+		"GOSYNC_ALERT_STATE="+alert.State,
+		fmt.Sprintf("GOSYNC_ALERT_LAG=%d", int64(alert.Lag.Seconds())),
+		fmt.Sprintf("GOSYNC_ALERT_MAX_LAG=%d", int64(alert.MaxLag.Seconds())),
+		"GOSYNC_ALERT_OLDEST="+formatTime(alert.Oldest),
+		"GOSYNC_ALERT_TIME="+formatTime(alert.Time),
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// 以JSON格式POST告警信息
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+type webhookPayload struct {
+	Queue  string  `json:"queue"`
+	State  string  `json:"state"`
+	Lag    float64 `json:"lag"`
+	MaxLag float64 `json:"max-lag"`
+	Oldest string  `json:"oldest,omitempty"`
+	Time   string  `json:"time"`
+}
+
+func (notifier *webhookNotifier) Notify(ctx context.Context, alert Alert) error {
+	body, err := json.Marshal(webhookPayload{
+		Queue:  alert.Queue,
+		State:  alert.State,
+		Lag:    alert.Lag.Seconds(),
+		MaxLag: alert.MaxLag.Seconds(),
+		Oldest: formatTime(alert.Oldest),
+		Time:   formatTime(alert.Time),
+	})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, notifier.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := notifier.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response: %s", response.Status)
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
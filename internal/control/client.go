@@ -0,0 +1,80 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// 控制接口的客户端
+type Client struct {
+	client *http.Client
+}
+
+func NewClient(path string) *Client {
+	return &Client{client: &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		},
+		Timeout: 10 * time.Second,
+	}}
+}
+
+func (client *Client) Status(queue string) ([]QueueStatus, error) {
+	statuses := []QueueStatus{}
+	err := client.call(http.MethodGet, "/status", url.Values{"queue": {queue}}, &statuses)
+	return statuses, err
+}
+
+func (client *Client) List(queue string) ([]QueueList, error) {
+	lists := []QueueList{}
+	err := client.call(http.MethodGet, "/queue", url.Values{"queue": {queue}}, &lists)
+	return lists, err
+}
+
+// 对队列执行full-sync、pause、resume或retry-now，返回队列的最新状态
+func (client *Client) Do(command string, queue string) ([]QueueStatus, error) {
+	statuses := []QueueStatus{}
+	err := client.call(http.MethodPost, "/"+command, url.Values{"queue": {queue}}, &statuses)
+	return statuses, err
+}
+
+// level为空时只查询当前的日志等级
+func (client *Client) LogLevel(level string) (string, error) {
+	var result LogLevel
+	var err error
+	if level == "" {
+		err = client.call(http.MethodGet, "/log-level", nil, &result)
+	} else {
+		err = client.call(http.MethodPost, "/log-level", url.Values{"level": {level}}, &result)
+	}
+	return result.Level, err
+}
+
+func (client *Client) call(method string, path string, query url.Values, out any) error {
+	request, err := http.NewRequest(method, "http://gosync"+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		var e Error
+		if json.NewDecoder(response.Body).Decode(&e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return fmt.Errorf("unexpected response: %s", response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(out)
+}
@@ -0,0 +1,197 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gosync/internal/watcher"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 本地控制接口，通过Unix domain socket提供HTTP+JSON服务，只允许socket文件的属主访问
+type Server struct {
+	path        string
+	queues      map[string][]*watcher.Queue
+	setLogLevel func(string) bool
+	listener    net.Listener
+	server      *http.Server
+}
+
+type QueueStatus = watcher.QueueStatus
+
+// 返回给客户端的错误信息
+type Error struct {
+	Error string `json:"error"`
+}
+
+func Start(path string, queues map[string][]*watcher.Queue, setLogLevel func(string) bool) (*Server, error) {
+	// 上次异常退出时socket文件没有被删除，能连接说明有其他进程正在使用
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		os.Remove(path)
+	}
+	listener, err := listen(path)
+	if err != nil {
+		return nil, err
+	}
+	server := &Server{path: path, queues: queues, setLogLevel: setLogLevel, listener: listener}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", server.status)
+	mux.HandleFunc("GET /queue", server.list)
+	mux.HandleFunc("POST /full-sync", server.each((*watcher.Queue).ScheduleFullSync))
+	mux.HandleFunc("POST /pause", server.each((*watcher.Queue).Pause))
+	mux.HandleFunc("POST /resume", server.each((*watcher.Queue).Resume))
+	mux.HandleFunc("POST /retry-now", server.each((*watcher.Queue).RetryNow))
+	mux.HandleFunc("GET /log-level", server.logLevel)
+	mux.HandleFunc("POST /log-level", server.logLevel)
+	server.server = &http.Server{Handler: mux}
+	go func() {
+		err := server.server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.WithError(err).Errorf("Control socket %s stopped.", path)
+		}
+	}()
+	logrus.Infof("Control socket %s started.", path)
+	return server, nil
+}
+
+// 先在只有属主可以访问的临时目录中创建socket并修改权限，再移动到path，
+// 避免在创建socket和修改权限之间被其他用户连接
+func listen(path string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".gosync-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "ctl.sock")
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// 移动后由Close删除path
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	err = os.Chmod(tmp, 0600)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// 关闭时会同时删除socket文件
+func (server *Server) Close() error {
+	if server == nil {
+		return nil
+	}
+	err := server.server.Close()
+	os.Remove(server.path)
+	return err
+}
+
+// 按queue参数选择队列，可以是同步目标的名称或者"同步目标/远端"，未指定时选择全部队列
+func (server *Server) selectQueues(r *http.Request) ([]*watcher.Queue, error) {
+	name := r.URL.Query().Get("queue")
+	selected := []*watcher.Queue{}
+	for target, queues := range server.queues {
+		for _, queue := range queues {
+			if name == "" || name == target || name == queue.Name() {
+				selected = append(selected, queue)
+			}
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("queue %s not found", name)
+	}
+	return selected, nil
+}
+
+func (server *Server) status(w http.ResponseWriter, r *http.Request) {
+	queues, err := server.selectQueues(r)
+	if err != nil {
+		reply(w, http.StatusNotFound, Error{Error: err.Error()})
+		return
+	}
+	statuses := []QueueStatus{}
+	for _, queue := range queues {
+		statuses = append(statuses, queue.Status())
+	}
+	sortByName(statuses, func(status QueueStatus) string { return status.Name })
+	reply(w, http.StatusOK, statuses)
+}
+
+// 队列中等待同步的任务
+type QueueList struct {
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+func (server *Server) list(w http.ResponseWriter, r *http.Request) {
+	queues, err := server.selectQueues(r)
+	if err != nil {
+		reply(w, http.StatusNotFound, Error{Error: err.Error()})
+		return
+	}
+	lists := []QueueList{}
+	for _, queue := range queues {
+		lists = append(lists, QueueList{Name: queue.Name(), Actions: queue.List()})
+	}
+	sortByName(lists, func(list QueueList) string { return list.Name })
+	reply(w, http.StatusOK, lists)
+}
+
+// 对选中的每个队列执行操作，返回队列的最新状态
+func (server *Server) each(fn func(*watcher.Queue)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queues, err := server.selectQueues(r)
+		if err != nil {
+			reply(w, http.StatusNotFound, Error{Error: err.Error()})
+			return
+		}
+		for _, queue := range queues {
+			fn(queue)
+		}
+		server.status(w, r)
+	}
+}
+
+// 临时修改日志等级，重新加载配置后恢复为配置文件中的等级
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+func (server *Server) logLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		level := strings.ToUpper(r.URL.Query().Get("level"))
+		if !server.setLogLevel(level) {
+			reply(w, http.StatusBadRequest, Error{Error: fmt.Sprintf("log level %s is invalid", level)})
+			return
+		}
+		logrus.Infof("Log level changed to %s.", level)
+	}
+	reply(w, http.StatusOK, LogLevel{Level: strings.ToUpper(logrus.GetLevel().String())})
+}
+
+func reply(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func sortByName[T any](items []T, name func(T) string) {
+	sort.Slice(items, func(i, j int) bool {
+		return name(items[i]) < name(items[j])
+	})
+}
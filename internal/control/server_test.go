@@ -0,0 +1,39 @@
+package control
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gosync/internal/watcher"
+)
+
+func TestSocketPermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gosync.sock")
+	server, err := Start(path, map[string][]*watcher.Queue{}, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode is %s", info.Mode())
+	}
+	// 临时目录已经删除
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("unexpected files next to the socket: %v", entries)
+	}
+	if _, err := NewClient(path).LogLevel(""); err != nil {
+		t.Errorf("log-level failed: %v", err)
+	}
+	if _, err := Start(path, nil, nil); err == nil {
+		t.Error("second server should fail while the socket is in use")
+	}
+	server.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket not removed after close: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package dest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gosync/conf"
+)
+
+// 单个文件的同步结果，Sent为发送的文件数据的字节数。
+// Change为rsync的变更代码，如">f.st......"、"cd+++++++++"、"*deleting"，原生引擎和对象存储为空，表示传输了文件内容。
+type FileResult struct {
+	Path   string
+	Size   int64
+	Sent   int64
+	Change string
+	Err    error
+}
+
+// 传输了文件内容
+func (result FileResult) Transferred() bool {
+	if result.Change == "" {
+		return true
+	}
+	return len(result.Change) > 1 && (result.Change[0] == '<' || result.Change[0] == '>') && result.Change[1] == 'f'
+}
+
+// 在远端删除
+func (result FileResult) Deleted() bool {
+	return result.Change == "*deleting"
+}
+
+// 一次批量调用的结果，Failed为同步失败的路径，Err为第一个失败的原因
+type Result struct {
+	Failed []string
+	Err    error
+}
+
+// 所有路径都同步成功
+func (result Result) OK() bool {
+	return len(result.Failed) == 0
+}
+
+// 记录同步失败的路径，只保留第一个失败的原因
+func (result *Result) Fail(path string, err error) {
+	result.Failed = append(result.Failed, path)
+	if result.Err == nil {
+		result.Err = err
+	}
+}
+
+// 远端操作失败的原因。Fatal表示连接、认证等失败，此时逐个路径重试也不会成功。
+// Code为rsync的退出码，其他远端为0。
+type Error struct {
+	Op    string
+	Code  int
+	Fatal bool
+	Err   error
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("%s: %s", err.Op, err.Err.Error())
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+// 是否为不可恢复的错误
+func IsFatal(err error) bool {
+	var destErr *Error
+	return errors.As(err, &destErr) && destErr.Fatal
+}
+
+// 同步队列推送变更的远端，rsync和对象存储各有一种实现，Fake用于测试队列的行为。
+// 批量方法返回同步失败的路径，队列会在重试间隔后重新同步这些路径。
+// ctx被取消时中止执行中的传输，未完成的路径作为失败返回。
+type Destination interface {
+	// 队列名称，同步目标或"同步目标/远端"
+	Name() string
+	Config() *conf.RsyncConfig
+	// 同步目标的监听范围，返回nil表示监听整个目录
+	WatchFolders() ([]string, error)
+	// 设置接收单个文件传输结果的回调
+	SetReporter(reporter func(FileResult))
+	FullSync(ctx context.Context) error
+	SyncFiles(ctx context.Context, paths []string) Result
+	DeleteFiles(ctx context.Context, paths []string) Result
+	SyncAttrs(ctx context.Context, paths []string) Result
+	Rename(ctx context.Context, from string, to string) error
+	// 释放临时文件等资源
+	Close()
+}
@@ -0,0 +1,149 @@
+package dest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gosync/conf"
+	"sync"
+	"time"
+)
+
+// 远端收到的一次调用，Op为full、sync、delete、attrib或rename，From为重命名的原路径
+type Call struct {
+	Op    string
+	Paths []string
+	From  string
+}
+
+// 只在内存中记录调用的远端，不传输任何数据，用于在没有rsyncd的环境中验证队列的合并、调度和重试。
+// FailPath使指定的路径失败若干次，SetUnavailable使所有调用以不可恢复的错误失败。
+type Fake struct {
+	name        string
+	config      *conf.RsyncConfig
+	mu          sync.Mutex
+	calls       []Call
+	failures    map[string]int
+	unavailable bool
+	delay       time.Duration
+	reporter    func(FileResult)
+}
+
+func NewFake(name string, config *conf.RsyncConfig) *Fake {
+	return &Fake{name: name, config: config, failures: map[string]int{}}
+}
+
+func (fake *Fake) Name() string {
+	return fake.name
+}
+
+func (fake *Fake) Config() *conf.RsyncConfig {
+	return fake.config
+}
+
+func (fake *Fake) WatchFolders() ([]string, error) {
+	return nil, nil
+}
+
+func (fake *Fake) SetReporter(reporter func(FileResult)) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.reporter = reporter
+}
+
+func (fake *Fake) Close() {}
+
+// 之后对path的times次调用失败，path为空时对应全量同步
+func (fake *Fake) FailPath(path string, times int) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.failures[path] = times
+}
+
+// 模拟远端无法连接
+func (fake *Fake) SetUnavailable(unavailable bool) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.unavailable = unavailable
+}
+
+// 每次调用的耗时，用于模拟执行中的任务
+func (fake *Fake) SetDelay(delay time.Duration) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.delay = delay
+}
+
+// 返回并清空已记录的调用
+func (fake *Fake) Calls() []Call {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	calls := fake.calls
+	fake.calls = nil
+	return calls
+}
+
+func (fake *Fake) FullSync(ctx context.Context) error {
+	return fake.call(ctx, Call{Op: "full"}, []string{""}).Err
+}
+
+func (fake *Fake) SyncFiles(ctx context.Context, paths []string) Result {
+	return fake.call(ctx, Call{Op: "sync", Paths: paths}, paths)
+}
+
+func (fake *Fake) DeleteFiles(ctx context.Context, paths []string) Result {
+	if !fake.config.AllowDelete {
+		return Result{}
+	}
+	return fake.call(ctx, Call{Op: "delete", Paths: paths}, paths)
+}
+
+func (fake *Fake) SyncAttrs(ctx context.Context, paths []string) Result {
+	return fake.call(ctx, Call{Op: "attrib", Paths: paths}, paths)
+}
+
+func (fake *Fake) Rename(ctx context.Context, from string, to string) error {
+	return fake.call(ctx, Call{Op: "rename", Paths: []string{to}, From: from}, []string{to}).Err
+}
+
+// 记录调用并按设置的失败次数返回结果，被取消或远端不可用时所有路径都失败
+func (fake *Fake) call(ctx context.Context, call Call, paths []string) Result {
+	fake.mu.Lock()
+	delay := fake.delay
+	fake.mu.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+	fake.mu.Lock()
+	call.Paths = append([]string(nil), call.Paths...)
+	fake.calls = append(fake.calls, call)
+	var fatal error
+	if ctx.Err() != nil {
+		fatal = ctx.Err()
+	} else if fake.unavailable {
+		fatal = errors.New("destination unavailable")
+	}
+	result := Result{}
+	succeeded := []string{}
+	for _, path := range paths {
+		if fatal != nil {
+			result.Fail(path, &Error{Op: call.Op, Fatal: true, Err: fatal})
+		} else if fake.failures[path] > 0 {
+			fake.failures[path]--
+			result.Fail(path, &Error{Op: call.Op, Err: fmt.Errorf("%s failed", path)})
+		} else if call.Op != "full" && call.Op != "delete" {
+			succeeded = append(succeeded, path)
+		}
+	}
+	reporter := fake.reporter
+	fake.mu.Unlock()
+	if reporter != nil {
+		for _, path := range succeeded {
+			reporter(FileResult{Path: path})
+		}
+	}
+	return result
+}
@@ -1,12 +1,17 @@
 package job
 
 import (
+	"context"
 	"fmt"
 	"gosync/conf"
+	"gosync/internal/metrics"
 	"gosync/internal/watcher"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/robfig/cron/v3"
@@ -23,73 +28,181 @@ func (logger CronLogrus) Error(err error, msg string, keysAndValues ...interface
 	logrus.WithError(err).Errorf(msg, keysAndValues...)
 }
 
+// c、config和queues在重新加载配置时会被替换，由mu保护
+var mu sync.Mutex
 var c *cron.Cron
 var config *conf.Config
-var queue *watcher.Queue
-
-func Start(cf *conf.Config, q *watcher.Queue) error {
-	config = cf
-	c = cron.New(cron.WithLogger(CronLogrus{}))
-	queue = q
-	if cf.Rsync.FullSync != "startup" && cf.Rsync.FullSync != "none" {
-		cf.Jobs = append(cf.Jobs, conf.JobConfig{
-			Cron:    cf.Rsync.FullSync,
-			Command: "full-sync",
-		})
+var queues map[string][]*watcher.Queue
+
+// 停止时取消正在执行的命令和尚未触发的@after任务
+var ctx, cancel = context.WithCancel(context.Background())
+var timers []*time.Timer
+
+func Start(cf *conf.Config, qs map[string][]*watcher.Queue) error {
+	mu.Lock()
+	queues = qs
+	mu.Unlock()
+	jobs := jobsOf(cf)
+	cr, afters, err := create(jobs, false)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	c, config = cr, cf
+	timers = append(timers, afters...)
+	mu.Unlock()
+	cr.Start()
+	logrus.Infof("Total of %d scheduled jobs started.", len(jobs))
+	return nil
+}
+
+// 按新的配置重新创建定时任务，新的配置有误时保留原来的定时任务。
+// @after任务只在启动后执行一次，重新加载时不会再次添加。
+func Reload(cf *conf.Config) error {
+	jobs := jobsOf(cf)
+	cr, _, err := create(jobs, true)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	old := c
+	c, config = cr, cf
+	mu.Unlock()
+	old.Stop()
+	cr.Start()
+	logrus.Infof("Total of %d scheduled jobs reloaded.", len(jobs))
+	return nil
+}
+
+// 配置的定时任务，以及按同步目标的full-sync生成的全量同步任务，不修改传入的配置
+func jobsOf(cf *conf.Config) []conf.JobConfig {
+	jobs := append([]conf.JobConfig{}, cf.Jobs...)
+	for _, target := range cf.Targets {
+		if target.FullSync != "startup" && target.FullSync != "reconcile" && target.FullSync != "none" {
+			jobs = append(jobs, conf.JobConfig{
+				Cron:    target.FullSync,
+				Command: "full-sync",
+				Target:  target.Name,
+			})
+		}
 	}
-	for _, job := range cf.Jobs {
-		err := Add(job.Cron, job.Command)
+	return jobs
+}
+
+// 创建定时任务，返回@after任务的定时器，由调用方在持有mu时记录。创建失败时已经创建的定时器会被停止。
+func create(jobs []conf.JobConfig, reload bool) (*cron.Cron, []*time.Timer, error) {
+	cr := cron.New(cron.WithLogger(CronLogrus{}))
+	afters := []*time.Timer{}
+	for _, job := range jobs {
+		if reload && strings.HasPrefix(strings.ToLower(job.Cron), "@after ") {
+			continue
+		}
+		timer, err := add(cr, job)
 		if err != nil {
-			return err
+			for _, timer := range afters {
+				timer.Stop()
+			}
+			return nil, nil, err
+		}
+		if timer != nil {
+			afters = append(afters, timer)
 		}
 	}
-	c.Start()
-	logrus.Infof("Total of %d scheduled jobs started.", len(cf.Jobs))
-	return nil
+	return cr, afters, nil
 }
 
+// 停止定时任务，正在执行的命令会被结束，等待其退出
 func Stop() {
-	c.Stop()
+	mu.Lock()
+	cancel()
+	for _, timer := range timers {
+		timer.Stop()
+	}
+	done := c.Stop()
+	mu.Unlock()
+	<-done.Done()
 	logrus.Info("Scheduled jobs stopped.")
 }
 
-func Add(cron string, command string) error {
-	if strings.HasPrefix(strings.ToLower(cron), "@after ") {
-		after, err := time.ParseDuration(cron[7:])
-		if err != nil {
-			return fmt.Errorf("failed to parse after %s: %s", cron, err)
-		}
-		time.AfterFunc(after, func() {
-			run(command)
-		})
-	} else {
-		_, err := c.AddFunc(cron, func() {
-			run(command)
-		})
+func Add(cron string, command string, target string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	timer, err := add(c, conf.JobConfig{Cron: cron, Command: command, Target: target})
+	if timer != nil {
+		timers = append(timers, timer)
+	}
+	return err
+}
+
+// 指标中任务的名称，未配置name时取命令的文件名，不包含参数
+func jobName(job conf.JobConfig) string {
+	if job.Name != "" {
+		return job.Name
+	}
+	if strings.ToLower(job.Command) == "full-sync" {
+		return "full-sync"
+	}
+	return filepath.Base(strings.Split(job.Command, " ")[0])
+}
+
+// 添加一个定时任务，@after任务返回其定时器
+func add(c *cron.Cron, job conf.JobConfig) (*time.Timer, error) {
+	name, command, target := jobName(job), job.Command, job.Target
+	if strings.HasPrefix(strings.ToLower(job.Cron), "@after ") {
+		after, err := time.ParseDuration(job.Cron[7:])
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("failed to parse after %s: %s", job.Cron, err)
 		}
+		return time.AfterFunc(after, func() {
+			run(name, command, target)
+		}), nil
 	}
-	return nil
+	_, err := c.AddFunc(job.Cron, func() {
+		run(name, command, target)
+	})
+	return nil, err
 }
 
-func run(command string) bool {
+func run(name string, command string, target string) bool {
+	mu.Lock()
+	config, queues := config, queues
+	mu.Unlock()
 	if strings.ToLower(command) == "full-sync" {
-		queue.ScheduleFullSync()
+		for name, qs := range queues {
+			if target == "" || target == name {
+				for _, queue := range qs {
+					queue.ScheduleFullSync()
+				}
+			}
+		}
+		metrics.JobRuns.Inc(name, target, "success")
 		return true
 	} else {
 		logrus.Infof("Run job: %s", command)
 		args := strings.Split(command, " ")
-		cmd := exec.Command(args[0], args[1:]...)
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
 		cmd.Dir = config.Dir
-		cmd.Env = append(os.Environ(),
-			"RSYNC_HOST="+config.Rsync.Host,
-			"RSYNC_PORT="+string(config.Rsync.Port),
-			"RSYNC_USERNAME="+config.Rsync.Username,
-			"RSYNC_PASSWORD="+config.Rsync.Password,
-			"RSYNC_SPACE="+config.Rsync.Space,
-			"RSYNC_ROOT_PATH="+config.Rsync.RootPath,
-		)
+		cmd.Env = os.Environ()
+		// 未指定目标时，只有一个同步目标的情况下默认使用该目标
+		rsync := config.GetTarget(target)
+		if rsync == nil && len(config.Targets) == 1 {
+			rsync = &config.Targets[0]
+		}
+		if rsync != nil {
+			// 多个远端时使用第一个远端的配置
+			dest := rsync.Destinations[0]
+			cmd.Env = append(cmd.Env,
+				"RSYNC_NAME="+rsync.Name,
+				"RSYNC_HOST="+dest.Host,
+				"RSYNC_PORT="+strconv.Itoa(dest.Port),
+				"RSYNC_USERNAME="+dest.Username,
+				"RSYNC_PASSWORD="+dest.Password,
+				"RSYNC_SPACE="+dest.Space,
+				"RSYNC_TRANSPORT="+dest.Transport,
+				"RSYNC_REMOTE_PATH="+dest.RemotePath,
+				"RSYNC_ROOT_PATH="+rsync.RootPath,
+			)
+		}
 		if logrus.IsLevelEnabled(logrus.DebugLevel) {
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
@@ -97,9 +210,11 @@ func run(command string) bool {
 		err := cmd.Run()
 		if err != nil {
 			logrus.WithError(err).Error("Run job failed.")
+			metrics.JobRuns.Inc(name, target, "failure")
 			return false
 		} else {
 			logrus.Info("Run job successfully.")
+			metrics.JobRuns.Inc(name, target, "success")
 			return true
 		}
 	}
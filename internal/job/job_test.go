@@ -0,0 +1,52 @@
+package job
+
+import (
+	"context"
+	"gosync/conf"
+	"sync"
+	"testing"
+)
+
+// 生成的全量同步任务不写回配置，多次重新加载后任务数不变
+func TestReloadKeepsConfig(t *testing.T) {
+	cf := &conf.Config{
+		Targets: []conf.RsyncConfig{{Name: "data", FullSync: "@every 1h"}, {Name: "logs", FullSync: "startup"}},
+		Jobs:    []conf.JobConfig{{Cron: "@every 1h", Command: "true"}, {Cron: "@after 1h", Command: "true"}},
+	}
+	// 包级状态在进程内共享，重复运行时先恢复初始状态
+	mu.Lock()
+	timers = nil
+	ctx, cancel = context.WithCancel(context.Background())
+	mu.Unlock()
+	if err := Start(cf, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := Reload(cf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(cf.Jobs) != 2 {
+		t.Errorf("config has %d jobs after reload: %+v", len(cf.Jobs), cf.Jobs)
+	}
+	mu.Lock()
+	entries, afters := len(c.Entries()), len(timers)
+	mu.Unlock()
+	if entries != 2 || afters != 1 {
+		t.Errorf("%d cron entries and %d @after timers, want 2 and 1", entries, afters)
+	}
+
+	// 重新加载与停止并发执行
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		Reload(cf)
+	}()
+	go func() {
+		defer wg.Done()
+		Add("@after 1h", "true", "")
+	}()
+	Stop()
+	wg.Wait()
+}
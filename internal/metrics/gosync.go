@@ -0,0 +1,48 @@
+package metrics
+
+// gosync的运行指标，queue标签为队列名称(同步目标或"同步目标/远端")
+var (
+	QueueDepth = NewGauge("gosync_queue_depth",
+		"Number of sync tasks waiting in the queue.", "queue")
+	QueueOffered = NewCounter("gosync_queue_offered_total",
+		"Sync tasks added to the queue.", "queue", "method")
+	QueueIgnored = NewCounter("gosync_queue_ignored_total",
+		"Changes ignored because a pending task already covers them.", "queue", "method")
+	QueueDropped = NewCounter("gosync_queue_dropped_total",
+		"Pending sync tasks dropped because a newer task covers them.", "queue", "method")
+	RetryWaits = NewCounter("gosync_retry_waits_total",
+		"Times the queue waited retry-interval after a failure.", "queue")
+	CapacityFallbacks = NewCounter("gosync_capacity_fallbacks_total",
+		"Times the queue exceeded queue.capacity and fell back to a full sync.", "queue")
+
+	RsyncRuns = NewCounter("gosync_rsync_runs_total",
+		"Rsync invocations by type and outcome.", "queue", "type", "outcome")
+	RsyncSentBytes = NewCounter("gosync_rsync_sent_bytes_total",
+		"Bytes sent by rsync, parsed from --stats.", "queue")
+	RsyncLiteralBytes = NewCounter("gosync_rsync_literal_bytes_total",
+		"File data sent literally by the rsync command, parsed from --stats.", "queue")
+	RsyncMatchedBytes = NewCounter("gosync_rsync_matched_bytes_total",
+		"File data matched against the remote basis files by the rsync command, parsed from --stats.", "queue")
+	RsyncDeletedFiles = NewCounter("gosync_rsync_deleted_files_total",
+		"Files deleted on the remote by the rsync command.", "queue")
+	TransferFiles = NewCounter("gosync_transfer_files_total",
+		"Files whose content was sent to the remote by outcome.", "queue", "outcome")
+
+	Watches = NewGauge("gosync_watches",
+		"Number of inotify watches.", "target")
+	WatchOverflows = NewCounter("gosync_watch_overflows_total",
+		"Kernel event queue overflows.", "target")
+	WatchReadErrors = NewCounter("gosync_watch_read_errors_total",
+		"Failures reading kernel events.", "target")
+
+	ReplicationLatency = NewHistogram("gosync_replication_latency_seconds",
+		"Time from a change to its successful sync to the remote.",
+		[]float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}, "queue")
+	OldestUnsyncedAge = NewGauge("gosync_oldest_unsynced_age_seconds",
+		"Age of the oldest change not yet synced to the remote, 0 if none.", "queue")
+	LagAlerts = NewCounter("gosync_lag_alerts_total",
+		"Replication lag alerts fired.", "queue")
+
+	JobRuns = NewCounter("gosync_job_runs_total",
+		"Scheduled job runs by outcome.", "job", "target", "outcome")
+)
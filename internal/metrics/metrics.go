@@ -0,0 +1,235 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 简单实现Prometheus文本格式的counter和gauge，只需要按标签计数，不引入客户端库
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	mu      sync.Mutex
+	samples map[string]*sample
+}
+
+type sample struct {
+	labels []string
+	value  float64
+}
+
+type collector interface {
+	write(b *strings.Builder)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []collector
+)
+
+func register(name string, help string, kind string, labels []string) *metric {
+	m := &metric{name: name, help: help, kind: kind, labels: labels, samples: map[string]*sample{}}
+	registryMu.Lock()
+	registry = append(registry, m)
+	registryMu.Unlock()
+	return m
+}
+
+// 按标签值取样本，标签值的数量必须与定义一致
+func (m *metric) update(values []string, fn func(*sample)) {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s requires %d labels, got %d", m.name, len(m.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.samples[key]
+	if !ok {
+		s = &sample{labels: values}
+		m.samples[key] = s
+	}
+	fn(s)
+}
+
+func (m *metric) write(b *strings.Builder) {
+	m.mu.Lock()
+	samples := make([]sample, 0, len(m.samples))
+	for _, s := range m.samples {
+		samples = append(samples, *s)
+	}
+	m.mu.Unlock()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labels, "\xff") < strings.Join(samples[j].labels, "\xff")
+	})
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, s := range samples {
+		b.WriteString(m.name)
+		if len(m.labels) > 0 {
+			b.WriteByte('{')
+			for i, label := range m.labels {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				b.WriteString(label + "=" + quoteLabel(s.labels[i]))
+			}
+			b.WriteByte('}')
+		}
+		b.WriteString(" " + strconv.FormatFloat(s.value, 'g', -1, 64) + "\n")
+	}
+}
+
+type Counter struct {
+	*metric
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{register(name, help, "counter", labels)}
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *Counter) Add(value float64, labels ...string) {
+	c.update(labels, func(s *sample) { s.value += value })
+}
+
+type Gauge struct {
+	*metric
+}
+
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{register(name, help, "gauge", labels)}
+}
+
+func (g *Gauge) Set(value float64, labels ...string) {
+	g.update(labels, func(s *sample) { s.value = value })
+}
+
+// 直方图，buckets为各个桶的上限
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	samples map[string]*histogramSample
+}
+
+type histogramSample struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, samples: map[string]*histogramSample{}}
+	registryMu.Lock()
+	registry = append(registry, h)
+	registryMu.Unlock()
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labels ...string) {
+	if len(labels) != len(h.labels) {
+		panic(fmt.Sprintf("metric %s requires %d labels, got %d", h.name, len(h.labels), len(labels)))
+	}
+	key := strings.Join(labels, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.samples[key]
+	if !ok {
+		s = &histogramSample{labels: labels, counts: make([]uint64, len(h.buckets))}
+		h.samples[key] = s
+	}
+	for i, bucket := range h.buckets {
+		if value <= bucket {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *Histogram) write(b *strings.Builder) {
+	h.mu.Lock()
+	samples := make([]histogramSample, 0, len(h.samples))
+	for _, s := range h.samples {
+		samples = append(samples, histogramSample{labels: s.labels, counts: append([]uint64{}, s.counts...), count: s.count, sum: s.sum})
+	}
+	h.mu.Unlock()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labels, "\xff") < strings.Join(samples[j].labels, "\xff")
+	})
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, s := range samples {
+		labels := ""
+		for i, label := range h.labels {
+			labels += label + "=" + quoteLabel(s.labels[i]) + ","
+		}
+		for i, bucket := range h.buckets {
+			fmt.Fprintf(b, "%s_bucket{%sle=\"%s\"} %d\n", h.name, labels, strconv.FormatFloat(bucket, 'g', -1, 64), s.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, labels, s.count)
+		labels = strings.TrimSuffix(labels, ",")
+		if labels != "" {
+			labels = "{" + labels + "}"
+		}
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, labels, strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, labels, s.count)
+	}
+}
+
+// 输出所有指标
+func Write(b *strings.Builder) {
+	registryMu.Lock()
+	metrics := append([]collector{}, registry...)
+	registryMu.Unlock()
+	for _, m := range metrics {
+		m.write(b)
+	}
+}
+
+func handle(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	Write(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// 在listen地址上提供/metrics
+func Start(listen string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", handle)
+	server := &http.Server{Handler: mux}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.WithError(err).Errorf("Metrics server %s stopped.", listen)
+		}
+	}()
+	logrus.Infof("Metrics server started at http://%s/metrics.", listener.Addr())
+	return server, nil
+}
+
+// 文本格式的标签值只转义反斜杠、双引号和换行，其他字符按UTF-8原样输出
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLabelEscaping(t *testing.T) {
+	counter := NewCounter("test_escape_total", "Label escaping.", "queue")
+	counter.Inc("数据/备份\t\"a\\b\"\nc")
+	var b strings.Builder
+	counter.write(&b)
+	want := "test_escape_total{queue=\"数据/备份\t\\\"a\\\\b\\\"\\nc\"} 1\n"
+	if !strings.HasSuffix(b.String(), want) {
+		t.Errorf("got %q, want suffix %q", b.String(), want)
+	}
+}
+
+func TestHistogramLabelEscaping(t *testing.T) {
+	histogram := NewHistogram("test_escape_seconds", "Label escaping.", []float64{1}, "queue")
+	histogram.Observe(0.5, "数据")
+	var b strings.Builder
+	histogram.write(&b)
+	for _, line := range []string{
+		"test_escape_seconds_bucket{queue=\"数据\",le=\"1\"} 1\n",
+		"test_escape_seconds_bucket{queue=\"数据\",le=\"+Inf\"} 1\n",
+		"test_escape_seconds_sum{queue=\"数据\"} 0.5\n",
+		"test_escape_seconds_count{queue=\"数据\"} 1\n",
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("missing %q in %q", line, b.String())
+		}
+	}
+}
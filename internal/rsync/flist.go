@@ -0,0 +1,472 @@
+package rsync
+
+import (
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 文件列表中的一项，name为相对于传输根目录的路径，根目录本身为"."
+type fileEntry struct {
+	name  string
+	path  string
+	mode  uint32
+	size  int64
+	mtime int64
+	uid   uint32
+	gid   uint32
+	link  string
+	// 内容需要完整同步的目录，--delete时远端只在这些目录中删除多余的文件
+	top bool
+}
+
+func (e *fileEntry) isDir() bool {
+	return e.mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+func (e *fileEntry) isRegular() bool {
+	return e.mode&syscall.S_IFMT == syscall.S_IFREG
+}
+
+func (e *fileEntry) isLink() bool {
+	return e.mode&syscall.S_IFMT == syscall.S_IFLNK
+}
+
+// rsync的过滤规则，"- pattern"排除，"+ pattern"包含，按顺序第一条匹配的规则生效
+type filterRule struct {
+	text    string
+	include bool
+	dirOnly bool
+	base    bool
+	re      *regexp.Regexp
+}
+
+func parseRules(lines []string) []filterRule {
+	rules := []filterRule{}
+	for _, line := range lines {
+		include := strings.HasPrefix(line, "+ ")
+		pattern := line[2:]
+		rule := filterRule{text: line, include: include}
+		if len(pattern) > 1 && strings.HasSuffix(pattern, "/") {
+			rule.dirOnly = true
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+		anchored := strings.HasPrefix(pattern, "/")
+		pattern = strings.TrimPrefix(pattern, "/")
+		suffix := ""
+		if p, ok := strings.CutSuffix(pattern, "/***"); ok {
+			// dir/***同时匹配目录本身和其下的所有路径
+			pattern = p
+			suffix = "(/.*)?"
+		}
+		expr := wildcard(pattern) + suffix
+		if anchored {
+			expr = "^" + expr + "$"
+		} else if strings.Contains(pattern, "/") || strings.Contains(pattern, "**") || suffix != "" {
+			expr = "(^|/)" + expr + "$"
+		} else {
+			// 不含/的模式只匹配最后一级名称
+			rule.base = true
+			expr = "^" + expr + "$"
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			logrus.Warnf("Ignore invalid filter rule: %s", line)
+			continue
+		}
+		rule.re = re
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// **匹配任意字符，*和?不匹配/，开头的**/也可以匹配第一级路径
+func wildcard(pattern string) string {
+	expr := ""
+	if p, ok := strings.CutPrefix(pattern, "**/"); ok {
+		expr = "(.*/)?"
+		pattern = p
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				expr += ".*"
+				i++
+			} else {
+				expr += "[^/]*"
+			}
+		case '?':
+			expr += "[^/]"
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				expr += `\[`
+			} else {
+				expr += "[" + pattern[i+1:i+1+end] + "]"
+				i += end + 1
+			}
+		default:
+			expr += regexp.QuoteMeta(string(c))
+		}
+	}
+	return expr
+}
+
+func excluded(rules []filterRule, name string, dir bool) bool {
+	for _, rule := range rules {
+		if rule.dirOnly && !dir {
+			continue
+		}
+		target := name
+		if rule.base {
+			target = path.Base(name)
+		}
+		if rule.re.MatchString(target) {
+			return !rule.include
+		}
+	}
+	return false
+}
+
+// 构造文件列表，按符号链接策略读取属性并应用过滤规则
+type lister struct {
+	symlinks string
+	rules    []filterRule
+	entries  []*fileEntry
+	seen     map[string]bool
+	ioError  bool
+}
+
+func (client *Client) newLister(rules []string) *lister {
+	return &lister{symlinks: client.config.Symlinks, rules: parseRules(rules), seen: map[string]bool{}}
+}
+
+// 读取一个路径的属性，路径不存在、被排除或按策略跳过时返回nil
+func (l *lister) stat(name string, file string) *fileEntry {
+	var info os.FileInfo
+	var err error
+	if l.symlinks == "follow" {
+		info, err = os.Stat(file)
+	} else {
+		info, err = os.Lstat(file)
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.WithError(err).Warnf("Stat %s failed.", file)
+			l.ioError = true
+		}
+		return nil
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	entry := &fileEntry{
+		name:  name,
+		path:  file,
+		mode:  st.Mode,
+		size:  st.Size,
+		mtime: info.ModTime().Unix(),
+		uid:   st.Uid,
+		gid:   st.Gid,
+	}
+	switch {
+	case entry.isLink():
+		if l.symlinks == "skip" {
+			return nil
+		}
+		entry.link, err = os.Readlink(file)
+		if err != nil {
+			logrus.WithError(err).Warnf("Read link %s failed.", file)
+			l.ioError = true
+			return nil
+		}
+	case !entry.isDir() && !entry.isRegular():
+		logrus.Debugf("Skip non-regular file %s.", file)
+		return nil
+	}
+	if name != "." && excluded(l.rules, name, entry.isDir()) {
+		return nil
+	}
+	return entry
+}
+
+func (l *lister) add(entry *fileEntry) {
+	if l.seen[entry.name] {
+		return
+	}
+	l.seen[entry.name] = true
+	l.entries = append(l.entries, entry)
+}
+
+// 递归添加目录下的所有路径，先添加本级的路径再进入子目录
+func (l *lister) walk(name string, dir string) {
+	names, err := readDirNames(dir)
+	if err != nil {
+		logrus.WithError(err).Warnf("Read directory %s failed.", dir)
+		l.ioError = true
+		return
+	}
+	subdirs := []*fileEntry{}
+	for _, child := range names {
+		childName := child
+		if name != "." {
+			childName = name + "/" + child
+		}
+		entry := l.stat(childName, filepath.Join(dir, child))
+		if entry == nil {
+			continue
+		}
+		l.add(entry)
+		if entry.isDir() {
+			subdirs = append(subdirs, entry)
+		}
+	}
+	for _, entry := range subdirs {
+		l.walk(entry.name, entry.path)
+	}
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	slices.Sort(names)
+	return names, err
+}
+
+// 传输整个目录的内容，对应rsync的"dir/"源路径
+func (l *lister) listDir(dir string, recurse bool) bool {
+	entry := l.stat(".", dir)
+	if entry == nil || !entry.isDir() {
+		return false
+	}
+	entry.top = recurse
+	l.add(entry)
+	if recurse {
+		l.walk(".", dir)
+	}
+	return true
+}
+
+// 按相对路径传输多个路径，对应rsync的--files-from，上级目录作为隐含目录加入列表但不删除其中的文件
+func (l *lister) listPaths(root string, paths []string, recurse bool) {
+	for _, p := range paths {
+		name := strings.TrimSuffix(p, "/")
+		parts := strings.Split(name, "/")
+		for i := 1; i < len(parts); i++ {
+			parent := strings.Join(parts[:i], "/")
+			if l.seen[parent] {
+				continue
+			}
+			entry := l.stat(parent, root+parent)
+			if entry == nil || !entry.isDir() {
+				break
+			}
+			l.add(entry)
+		}
+		entry := l.stat(name, root+name)
+		if entry == nil || l.seen[name] {
+			continue
+		}
+		if entry.isDir() && recurse {
+			entry.top = true
+			l.add(entry)
+			l.walk(name, entry.path)
+		} else {
+			l.add(entry)
+		}
+	}
+}
+
+// 按rsync的规则排序，接收方以排序后的序号请求文件：逐级比较路径，同一级中文件排在目录之前，
+// 目录名按带/的形式比较
+func compareEntries(a *fileEntry, b *fileEntry) int {
+	if a.name == "." || b.name == "." {
+		if a.name == b.name {
+			return 0
+		} else if a.name == "." {
+			return -1
+		}
+		return 1
+	}
+	as := strings.Split(a.name, "/")
+	bs := strings.Split(b.name, "/")
+	for i := 0; ; i++ {
+		if i == len(as) || i == len(bs) {
+			return len(as) - len(bs)
+		}
+		aDir := i < len(as)-1 || a.isDir()
+		bDir := i < len(bs)-1 || b.isDir()
+		if aDir != bDir {
+			if aDir {
+				return 1
+			}
+			return -1
+		}
+		x, y := as[i], bs[i]
+		if aDir {
+			x += "/"
+			y += "/"
+		}
+		if x != y {
+			return strings.Compare(x, y)
+		}
+	}
+}
+
+// 文件列表中用户和组的名称，远端按名称映射为本地的id，0和找不到名称的id不发送
+type idList struct {
+	ids   []uint32
+	names map[uint32]string
+}
+
+func (list *idList) add(id uint32, lookup func(string) (string, error)) {
+	if list.names == nil {
+		list.names = map[uint32]string{}
+	}
+	if _, ok := list.names[id]; ok {
+		return
+	}
+	name, err := lookup(strconv.FormatUint(uint64(id), 10))
+	if err != nil {
+		name = ""
+	}
+	list.names[id] = name
+	if id != 0 && name != "" && len(name) < 256 {
+		list.ids = append(list.ids, id)
+	}
+}
+
+func lookupUser(id string) (string, error) {
+	u, err := user.LookupId(id)
+	if err != nil {
+		return "", err
+	}
+	return u.Username, nil
+}
+
+func lookupGroup(id string) (string, error) {
+	g, err := user.LookupGroupId(id)
+	if err != nil {
+		return "", err
+	}
+	return g.Name, nil
+}
+
+// 文件列表中每一项的标志位
+const (
+	xmitTopDir        = 1 << 0
+	xmitSameMode      = 1 << 1
+	xmitExtendedFlags = 1 << 2
+	xmitSameUID       = 1 << 3
+	xmitSameGID       = 1 << 4
+	xmitSameName      = 1 << 5
+	xmitLongName      = 1 << 6
+	xmitSameTime      = 1 << 7
+)
+
+// 发送文件列表，与上一项相同的属性和路径前缀不重复发送
+func (s *session) sendFileList(entries []*fileEntry, opts *transfer, ioError bool) {
+	var last *fileEntry
+	users, groups := &idList{}, &idList{}
+	for _, entry := range entries {
+		flags := 0
+		if entry.isDir() && entry.top {
+			flags |= xmitTopDir
+		}
+		if last != nil && entry.mode == last.mode {
+			flags |= xmitSameMode
+		}
+		if !opts.owner || (last != nil && entry.uid == last.uid) {
+			flags |= xmitSameUID
+		} else {
+			users.add(entry.uid, lookupUser)
+		}
+		if !opts.owner || (last != nil && entry.gid == last.gid) {
+			flags |= xmitSameGID
+		} else {
+			groups.add(entry.gid, lookupGroup)
+		}
+		if last != nil && entry.mtime == last.mtime {
+			flags |= xmitSameTime
+		}
+		same := 0
+		if last != nil {
+			for same < len(entry.name) && same < len(last.name) && same < 255 && entry.name[same] == last.name[same] {
+				same++
+			}
+		}
+		suffix := entry.name[same:]
+		if same > 0 {
+			flags |= xmitSameName
+		}
+		if len(suffix) > 255 {
+			flags |= xmitLongName
+		}
+		// 标志为0表示列表结束，文件上的xmitTopDir没有含义，可以用来占位
+		if flags == 0 && !entry.isDir() {
+			flags |= xmitTopDir
+		}
+		if flags == 0 {
+			s.writeShort(xmitExtendedFlags)
+		} else {
+			s.w.WriteByte(byte(flags))
+		}
+		if flags&xmitSameName != 0 {
+			s.w.WriteByte(byte(same))
+		}
+		if flags&xmitLongName != 0 {
+			s.writeInt(int32(len(suffix)))
+		} else {
+			s.w.WriteByte(byte(len(suffix)))
+		}
+		s.w.WriteString(suffix)
+		s.writeLong(entry.size)
+		if flags&xmitSameTime == 0 {
+			s.writeInt(int32(entry.mtime))
+		}
+		if flags&xmitSameMode == 0 {
+			s.writeInt(int32(entry.mode))
+		}
+		if flags&xmitSameUID == 0 {
+			s.writeInt(int32(entry.uid))
+		}
+		if flags&xmitSameGID == 0 {
+			s.writeInt(int32(entry.gid))
+		}
+		if opts.links && entry.isLink() {
+			s.writeInt(int32(len(entry.link)))
+			s.w.WriteString(entry.link)
+		}
+		last = entry
+	}
+	s.w.WriteByte(0)
+	if opts.owner {
+		for _, list := range []*idList{users, groups} {
+			for _, id := range list.ids {
+				s.writeInt(int32(id))
+				s.w.WriteByte(byte(len(list.names[id])))
+				s.w.WriteString(list.names[id])
+			}
+			s.writeInt(0)
+		}
+	}
+	if ioError && !opts.ignoreErrors {
+		s.writeInt(1)
+	} else {
+		s.writeInt(0)
+	}
+}
@@ -0,0 +1,181 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// 按rsync 29版协议接收方(receive_file_entry)的逻辑解码文件列表
+type flistReader struct {
+	t *testing.T
+	r *bytes.Reader
+}
+
+func (r *flistReader) byte() byte {
+	b, err := r.r.ReadByte()
+	if err != nil {
+		r.t.Fatal("unexpected end of file list")
+	}
+	return b
+}
+
+func (r *flistReader) int() int32 {
+	var buf [4]byte
+	if _, err := io.ReadFull(r.r, buf[:]); err != nil {
+		r.t.Fatal("unexpected end of file list")
+	}
+	return int32(binary.LittleEndian.Uint32(buf[:]))
+}
+
+func (r *flistReader) long() int64 {
+	v := r.int()
+	if v != -1 {
+		return int64(v)
+	}
+	var buf [8]byte
+	if _, err := io.ReadFull(r.r, buf[:]); err != nil {
+		r.t.Fatal("unexpected end of file list")
+	}
+	return int64(binary.LittleEndian.Uint64(buf[:]))
+}
+
+func (r *flistReader) string(n int) string {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		r.t.Fatal("unexpected end of file list")
+	}
+	return string(buf)
+}
+
+func (r *flistReader) entries(opts *transfer) []fileEntry {
+	entries := []fileEntry{}
+	last := fileEntry{}
+	for {
+		flags := int(r.byte())
+		if flags == 0 {
+			break
+		}
+		if flags&xmitExtendedFlags != 0 {
+			flags |= int(r.byte()) << 8
+		}
+		same := 0
+		if flags&xmitSameName != 0 {
+			same = int(r.byte())
+		}
+		n := 0
+		if flags&xmitLongName != 0 {
+			n = int(r.int())
+		} else {
+			n = int(r.byte())
+		}
+		entry := last
+		entry.name = last.name[:same] + r.string(n)
+		entry.link = ""
+		entry.size = r.long()
+		if flags&xmitSameTime == 0 {
+			entry.mtime = int64(r.int())
+		}
+		if flags&xmitSameMode == 0 {
+			entry.mode = uint32(r.int())
+		}
+		if opts.owner && flags&xmitSameUID == 0 {
+			entry.uid = uint32(r.int())
+		}
+		if opts.owner && flags&xmitSameGID == 0 {
+			entry.gid = uint32(r.int())
+		}
+		if opts.links && entry.isLink() {
+			entry.link = r.string(int(r.int()))
+		}
+		entry.top = entry.isDir() && flags&xmitTopDir != 0
+		entries = append(entries, entry)
+		last = entry
+	}
+	return entries
+}
+
+// 用户和组的名称列表，以id 0结束
+func (r *flistReader) ids() map[uint32]string {
+	names := map[uint32]string{}
+	for {
+		id := r.int()
+		if id == 0 {
+			return names
+		}
+		names[uint32(id)] = r.string(int(r.byte()))
+	}
+}
+
+func TestFileListRoundTrip(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	entries := []*fileEntry{
+		{name: ".", mode: syscall.S_IFDIR | 0755, mtime: 1700000000, top: true},
+		{name: "dir", mode: syscall.S_IFDIR | 0755, mtime: 1700000000, uid: 1, gid: 1},
+		{name: "dir/a.txt", mode: syscall.S_IFREG | 0644, size: 12, mtime: 1700000001, uid: 1, gid: 1},
+		{name: "dir/b.txt", mode: syscall.S_IFREG | 0644, size: 1 << 33, mtime: 1700000001, uid: 1, gid: 1},
+		{name: "dir/link", mode: syscall.S_IFLNK | 0777, size: 5, mtime: 1700000002, link: "a.txt"},
+		{name: "dir/" + long + "/1", mode: syscall.S_IFREG | 0600, mtime: 1700000003},
+		{name: "dir/" + long + "/2", mode: syscall.S_IFREG | 0600, mtime: 1700000003},
+		// 所有属性与上一项相同，标志需要占位
+		{name: "dir/" + long + "/3", mode: syscall.S_IFREG | 0600, mtime: 1700000003},
+		{name: "sub", mode: syscall.S_IFDIR | 0700, mtime: 1700000003, top: true},
+		{name: "sub2", mode: syscall.S_IFDIR | 0700, mtime: 1700000003},
+	}
+	for _, opts := range []*transfer{{links: true, owner: true}, {links: false, owner: false, ignoreErrors: true}} {
+		var buf bytes.Buffer
+		s := &session{w: bufio.NewWriter(&buf)}
+		s.sendFileList(entries, opts, true)
+		s.w.Flush()
+
+		r := &flistReader{t: t, r: bytes.NewReader(buf.Bytes())}
+		got := r.entries(opts)
+		if len(got) != len(entries) {
+			t.Fatalf("decoded %d entries, want %d", len(got), len(entries))
+		}
+		for i, entry := range entries {
+			want := *entry
+			if !opts.owner {
+				want.uid, want.gid = 0, 0
+			}
+			if !opts.links {
+				want.link = ""
+			}
+			if !reflect.DeepEqual(got[i], want) {
+				t.Errorf("entry %d = %+v, want %+v", i, got[i], want)
+			}
+		}
+		if opts.owner {
+			users, groups := &idList{}, &idList{}
+			for _, entry := range entries {
+				users.add(entry.uid, lookupUser)
+				groups.add(entry.gid, lookupGroup)
+			}
+			for _, list := range []*idList{users, groups} {
+				want := map[uint32]string{}
+				for _, id := range list.ids {
+					want[id] = list.names[id]
+				}
+				if got := r.ids(); !reflect.DeepEqual(got, want) {
+					t.Errorf("id list = %v, want %v", got, want)
+				}
+			}
+		}
+		// --ignore-errors时不报告读取错误
+		want := int32(1)
+		if opts.ignoreErrors {
+			want = 0
+		}
+		if ioError := r.int(); ioError != want {
+			t.Errorf("io error = %d, want %d", ioError, want)
+		}
+		if r.r.Len() != 0 {
+			t.Errorf("%d bytes left after file list", r.r.Len())
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package rsync
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// 29版协议的文件校验和与认证摘要使用MD4，标准库没有提供
+type md4 struct {
+	s    [4]uint32
+	buf  [64]byte
+	nbuf int
+	len  uint64
+}
+
+func newMD4() *md4 {
+	return &md4{s: [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}}
+}
+
+func (d *md4) Write(p []byte) (int, error) {
+	n := len(p)
+	d.len += uint64(n)
+	if d.nbuf > 0 {
+		c := copy(d.buf[d.nbuf:], p)
+		d.nbuf += c
+		p = p[c:]
+		if d.nbuf < 64 {
+			return n, nil
+		}
+		d.block(d.buf[:])
+		d.nbuf = 0
+	}
+	for len(p) >= 64 {
+		d.block(p[:64])
+		p = p[64:]
+	}
+	d.nbuf = copy(d.buf[:], p)
+	return n, nil
+}
+
+func (d *md4) Sum() []byte {
+	length := d.len << 3
+	pad := [64]byte{0x80}
+	n := 56 - int(d.len%64)
+	if n <= 0 {
+		n += 64
+	}
+	d.Write(pad[:n])
+	binary.LittleEndian.PutUint64(pad[:8], length)
+	d.Write(pad[:8])
+	sum := make([]byte, 16)
+	for i, v := range d.s {
+		binary.LittleEndian.PutUint32(sum[i*4:], v)
+	}
+	return sum
+}
+
+var (
+	md4Shift = [3][4]int{{3, 7, 11, 19}, {3, 5, 9, 13}, {3, 9, 11, 15}}
+	md4Round = [3][16]int{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+		{0, 4, 8, 12, 1, 5, 9, 13, 2, 6, 10, 14, 3, 7, 11, 15},
+		{0, 8, 4, 12, 2, 10, 6, 14, 1, 9, 5, 13, 3, 11, 7, 15},
+	}
+)
+
+func (d *md4) block(p []byte) {
+	var x [16]uint32
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(p[i*4:])
+	}
+	a, b, c, e := d.s[0], d.s[1], d.s[2], d.s[3]
+	for r := 0; r < 3; r++ {
+		for i := 0; i < 16; i++ {
+			var f uint32
+			switch r {
+			case 0:
+				f = b&c | ^b&e
+			case 1:
+				f = (b&c | b&e | c&e) + 0x5a827999
+			default:
+				f = (b ^ c ^ e) + 0x6ed9eba1
+			}
+			t := bits.RotateLeft32(a+f+x[md4Round[r][i]], md4Shift[r][i%4])
+			a, b, c, e = e, t, b, c
+		}
+	}
+	d.s[0] += a
+	d.s[1] += b
+	d.s[2] += c
+	d.s[3] += e
+}
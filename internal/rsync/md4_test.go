@@ -0,0 +1,38 @@
+package rsync
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// RFC 1320附录A.5的测试向量
+func TestMD4(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"", "31d6cfe0d16ae931b73c59d7e0c089c0"},
+		{"a", "bde52cb31de33e46245e05fbdbd6fb24"},
+		{"abc", "a448017aaf21d8525fc10ae87aa6729d"},
+		{"message digest", "d9130a8164549fe818874806e1c7014b"},
+		{"abcdefghijklmnopqrstuvwxyz", "d79e1c308aa5bbcdeea8ed63df412da9"},
+		{"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789", "043f8582f241db351ce627e153e7f0e4"},
+		{strings.Repeat("1234567890", 8), "e33b4ddc9c38f2199c3e7b164fcc0536"},
+	}
+	for _, test := range tests {
+		d := newMD4()
+		d.Write([]byte(test.input))
+		if got := hex.EncodeToString(d.Sum()); got != test.want {
+			t.Errorf("MD4(%q) = %s, want %s", test.input, got, test.want)
+		}
+		// 分多次写入的结果相同
+		d = newMD4()
+		for i := 0; i < len(test.input); i += 7 {
+			d.Write([]byte(test.input[i:min(i+7, len(test.input))]))
+		}
+		if got := hex.EncodeToString(d.Sum()); got != test.want {
+			t.Errorf("MD4(%q) in chunks = %s, want %s", test.input, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,521 @@
+package rsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gosync/internal/dest"
+	"gosync/internal/metrics"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 原生引擎的一次传输，对应一次rsync调用的选项
+type transfer struct {
+	// 远端路径，相对于模块
+	dest         string
+	entries      []*fileEntry
+	ioError      bool
+	recurse      bool
+	dirs         bool
+	relative     bool
+	links        bool
+	owner        bool
+	delete       bool
+	ignoreErrors bool
+	sizeOnly     bool
+	existing     bool
+	linkDest     string
+	rules        []string
+}
+
+// 远端rsync --server的参数
+func (client *Client) serverArgs(t *transfer) []string {
+	options := "-"
+	if t.recurse {
+		options += "r"
+	} else if t.dirs {
+		options += "d"
+	}
+	if t.links {
+		options += "l"
+	}
+	if t.owner {
+		options += "og"
+	}
+	options += "ptW"
+	if t.relative {
+		options += "R"
+	}
+	args := []string{"--server", options}
+	if t.delete {
+		args = append(args, "--delete")
+	}
+	if t.ignoreErrors {
+		args = append(args, "--ignore-errors")
+	}
+	if t.sizeOnly {
+		args = append(args, "--size-only")
+	}
+	if t.existing {
+		args = append(args, "--existing")
+	}
+	if t.linkDest != "" {
+		args = append(args, "--link-dest="+t.linkDest)
+	}
+	if client.dest.IOTimeout != "" {
+		// 远端在长时间没有输出时发送keepalive
+		timeout, _ := time.ParseDuration(client.dest.IOTimeout)
+		args = append(args, fmt.Sprintf("--timeout=%d", int(math.Ceil(timeout.Seconds()))))
+	}
+	return append(args, ".", client.dest.Space+"/"+t.dest)
+}
+
+// 与rsync -a相同，符号链接按策略处理，同步属主需要远端rsyncd以root运行
+func (client *Client) newTransfer(dest string) *transfer {
+	return &transfer{dest: dest, links: client.config.Symlinks == "copy", owner: true}
+}
+
+// 排除规则转换为过滤规则，与--exclude-from的效果相同
+func (client *Client) excludeRules() []string {
+	rules := []string{}
+	excludes := client.getExcludes()
+	for i := 1; i < len(excludes); i += 2 {
+		rules = append(rules, "- "+excludes[i])
+	}
+	return rules
+}
+
+// 只包含路径本身及其上级目录，其余路径都被排除
+func includeRules(paths []string) []string {
+	rules := []string{}
+	parents := map[string]bool{}
+	for _, path := range paths {
+		name := "/" + strings.TrimSuffix(path, "/")
+		for dir := filepath.Dir(name); dir != "/" && !parents[dir]; dir = filepath.Dir(dir) {
+			parents[dir] = true
+			rules = append(rules, "+ "+dir+"/")
+		}
+		rules = append(rules, "+ "+name, "+ "+name+"/***")
+	}
+	return append(rules, "- *")
+}
+
+func (client *Client) nativeFullSync(ctx context.Context) error {
+	config := client.config
+	t := client.newTransfer("")
+	t.recurse = true
+	t.delete = config.AllowDelete
+	t.ignoreErrors = config.AllowDelete
+	t.rules = client.excludeRules()
+	folders, err := client.WatchFolders()
+	if err != nil {
+		return client.done("full", err)
+	} else if folders != nil {
+		t.rules = append(t.rules, includeRules(folders)...)
+	}
+	l := client.newLister(t.rules)
+	if !l.listDir(config.RootPath, true) {
+		return client.done("full", fmt.Errorf("%s is not a directory", config.RootPath))
+	}
+	t.entries, t.ioError = l.entries, l.ioError
+	return client.done("full", client.push(ctx, "full", t))
+}
+
+func (client *Client) nativeSync(ctx context.Context, path string) error {
+	config := client.config
+	t := client.newTransfer(path)
+	t.rules = client.excludeRules()
+	l := client.newLister(t.rules)
+	if strings.HasSuffix(path, "/") {
+		t.recurse = true
+		t.delete = config.AllowDelete
+		t.ignoreErrors = config.AllowDelete
+		if !l.listDir(config.RootPath+path, true) {
+			logrus.Warn("Ignore rsync because path is not exists.")
+			return nil
+		}
+	} else {
+		entry := l.stat(filepath.Base(path), config.RootPath+path)
+		if entry == nil {
+			logrus.Warn("Ignore rsync because path is not exists.")
+			return nil
+		}
+		l.add(entry)
+	}
+	t.entries, t.ioError = l.entries, l.ioError
+	return client.done("sync", client.push(ctx, "sync", t))
+}
+
+// 只传输上级目录本身，过滤规则保护除path以外的路径，远端删除path
+func (client *Client) nativeDelete(ctx context.Context, path string) error {
+	config := client.config
+	if !config.AllowDelete {
+		return nil
+	}
+	parent := filepath.Dir(strings.TrimSuffix(path, "/")) + "/"
+	if parent == "./" {
+		parent = ""
+	}
+	t := client.newTransfer(parent)
+	t.recurse = true
+	t.delete = true
+	t.ignoreErrors = true
+	t.rules = append(client.excludeRules(), "+ /"+filepath.Base(path), "- *")
+	l := client.newLister(t.rules)
+	if !l.listDir(config.RootPath+parent, true) {
+		logrus.Warnf("Ignore delete because parent is not exists: %s", parent)
+		return nil
+	}
+	t.entries, t.ioError = l.entries, l.ioError
+	return client.done("delete", client.push(ctx, "delete", t))
+}
+
+// 目录通过--link-dest硬链接远端未变化的文件，原生引擎总是传输完整的文件，不使用--fuzzy
+func (client *Client) nativeRename(ctx context.Context, from string, to string) error {
+	config := client.config
+	err := client.exists(to)
+	if err == nil {
+		t := client.newTransfer(to)
+		t.rules = client.excludeRules()
+		l := client.newLister(t.rules)
+		if strings.HasSuffix(to, "/") {
+			rel, _ := filepath.Rel("/"+to, "/"+from)
+			t.linkDest = rel
+			t.recurse = true
+			t.delete = config.AllowDelete
+			t.ignoreErrors = config.AllowDelete
+			l.listDir(config.RootPath+to, true)
+		} else {
+			if filepath.Dir(from) != filepath.Dir(to) {
+				rel, _ := filepath.Rel("/"+filepath.Dir(to), "/"+filepath.Dir(from))
+				t.linkDest = rel
+			}
+			if entry := l.stat(filepath.Base(to), config.RootPath+to); entry != nil {
+				l.add(entry)
+			}
+		}
+		t.entries, t.ioError = l.entries, l.ioError
+		if len(t.entries) > 0 {
+			if err := client.done("rename", client.push(ctx, "rename", t)); err != nil {
+				return err
+			}
+		}
+	} else {
+		logrus.Warnf("Ignore rsync because path is not exists: %s", to)
+	}
+	return client.nativeDelete(ctx, from)
+}
+
+func (client *Client) nativeSyncFiles(ctx context.Context, paths []string) dest.Result {
+	config := client.config
+	t := client.newTransfer("")
+	t.recurse = true
+	t.relative = true
+	t.delete = config.AllowDelete
+	t.ignoreErrors = config.AllowDelete
+	t.rules = client.excludeRules()
+	l := client.newLister(t.rules)
+	l.listPaths(config.RootPath, paths, true)
+	if len(l.entries) == 0 {
+		return dest.Result{}
+	}
+	t.entries, t.ioError = l.entries, l.ioError
+	return client.runBatch(ctx, "sync", client.push(ctx, "sync", t), paths, client.nativeSync)
+}
+
+// 远端遍历过滤规则包含的目录，删除其中本地已不存在的路径
+func (client *Client) nativeDeleteFiles(ctx context.Context, paths []string) dest.Result {
+	config := client.config
+	if !config.AllowDelete {
+		return dest.Result{}
+	}
+	t := client.newTransfer("")
+	t.recurse = true
+	t.delete = true
+	t.ignoreErrors = true
+	t.rules = append(client.excludeRules(), includeRules(paths)...)
+	l := client.newLister(t.rules)
+	if !l.listDir(config.RootPath, true) {
+		return resultOf(paths, client.done("delete", fmt.Errorf("%s is not a directory", config.RootPath)))
+	}
+	t.entries, t.ioError = l.entries, l.ioError
+	return client.runBatch(ctx, "delete", client.push(ctx, "delete", t), paths, client.nativeDelete)
+}
+
+// 大小没有变化的文件只同步属性，远端还不存在的文件不创建
+func (client *Client) nativeSyncAttrs(ctx context.Context, paths []string) dest.Result {
+	config := client.config
+	t := client.newTransfer("")
+	t.dirs = true
+	t.relative = true
+	t.sizeOnly = true
+	t.existing = true
+	t.rules = client.excludeRules()
+	l := client.newLister(t.rules)
+	l.listPaths(config.RootPath, paths, false)
+	if len(l.entries) == 0 {
+		return dest.Result{}
+	}
+	t.entries, t.ioError = l.entries, l.ioError
+	if len(paths) == 1 {
+		return resultOf(paths, client.done("attrib", client.push(ctx, "attrib", t)))
+	}
+	return client.runBatch(ctx, "attrib", client.push(ctx, "attrib", t), paths, func(ctx context.Context, path string) error {
+		return client.nativeSyncAttrs(ctx, []string{path}).Err
+	})
+}
+
+// 请求和回复中的标志位
+const (
+	itemBasisTypeFollows = 1 << 11
+	itemXnameFollows     = 1 << 12
+	itemTransfer         = 1 << 15
+)
+
+const (
+	ndxDone   = -1
+	chunkSize = 32 * 1024
+	// 接收方的阶段：传输、重传校验失败的文件、更新目录属性
+	maxPhase = 2
+)
+
+// 连接rsyncd执行一次传输，按类型和结果计数。文件列表为空时不连接远端。
+func (client *Client) push(ctx context.Context, kind string, t *transfer) error {
+	var s *session
+	err := func() error {
+		var err error
+		s, err = client.connect(ctx, client.serverArgs(t))
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		stop := context.AfterFunc(ctx, func() {
+			logrus.Warnf("Abort rsync of %s.", client.Name())
+			s.Close()
+		})
+		defer stop()
+		return client.send(s, t)
+	}()
+	outcome := "success"
+	if ctx.Err() != nil {
+		outcome = "aborted"
+		if err != nil {
+			err = &exitError{codeStreamIO, ctx.Err()}
+		}
+	} else if err != nil {
+		outcome = "failure"
+	}
+	metrics.RsyncRuns.Inc(client.Name(), kind, outcome)
+	if s != nil && s.sent > 0 {
+		metrics.RsyncSentBytes.Add(float64(s.sent), client.Name())
+	}
+	return err
+}
+
+func (client *Client) send(s *session, t *transfer) error {
+	if t.delete {
+		// 远端删除时需要过滤规则来保护被排除的路径
+		for _, rule := range t.rules {
+			s.writeInt(int32(len(rule)))
+			s.w.WriteString(rule)
+		}
+		s.writeInt(0)
+	}
+	s.sendFileList(t.entries, t, t.ioError)
+
+	// 接收方按排序后的序号请求文件
+	sorted := slices.Clone(t.entries)
+	slices.SortStableFunc(sorted, compareEntries)
+	failed := false
+	phase := 0
+	for {
+		ndx, err := s.readInt()
+		if err != nil {
+			return err
+		}
+		if ndx == ndxDone {
+			phase++
+			if phase > maxPhase {
+				break
+			}
+			s.writeInt(ndxDone)
+			continue
+		}
+		iflags, err := s.readShort()
+		if err != nil {
+			return err
+		}
+		var basisType byte
+		if iflags&itemBasisTypeFollows != 0 {
+			basisType, err = s.readByte()
+			if err != nil {
+				return err
+			}
+		}
+		var xname []byte
+		if iflags&itemXnameFollows != 0 {
+			xname, err = s.readVstring()
+			if err != nil {
+				return err
+			}
+		}
+		if iflags&itemTransfer == 0 {
+			// 不需要传输的项原样回复
+			s.writeAttrs(ndx, iflags, basisType, xname)
+			continue
+		}
+		if ndx < 0 || int(ndx) >= len(sorted) || !sorted[ndx].isRegular() {
+			return &exitError{codeStreamIO, fmt.Errorf("invalid file index %d", ndx)}
+		}
+		head, err := s.readSumHead()
+		if err != nil {
+			return err
+		}
+		result := client.sendFile(s, sorted[ndx], ndx, iflags, basisType, xname, head)
+		if s.w.Buffered() > 0 {
+			if err := s.w.Flush(); err != nil {
+				return s.streamError(err)
+			}
+		}
+		if result.Err != nil {
+			var streamErr *exitError
+			if errors.As(result.Err, &streamErr) {
+				return result.Err
+			}
+			failed = true
+			logrus.WithError(result.Err).Errorf("Send %s failed.", result.Path)
+		}
+		client.reportFile(result)
+	}
+	s.writeInt(ndxDone)
+	// 结束时远端还会发送一次NDX_DONE
+	ndx, err := s.readInt()
+	if err != nil {
+		return err
+	}
+	if ndx != ndxDone {
+		return &exitError{codeStreamIO, fmt.Errorf("invalid packet at end of run (%d)", ndx)}
+	}
+	if errs := s.in.failures(); len(errs) > 0 {
+		return &exitError{codePartial, fmt.Errorf("rsyncd reported %d errors: %s", len(errs), errs[len(errs)-1])}
+	}
+	if failed {
+		return &exitError{codePartial, errors.New("some files could not be transferred")}
+	}
+	return nil
+}
+
+func (s *session) readVstring() ([]byte, error) {
+	b, err := s.readByte()
+	if err != nil {
+		return nil, err
+	}
+	n := int(b)
+	if n&0x80 != 0 {
+		low, err := s.readByte()
+		if err != nil {
+			return nil, err
+		}
+		n = (n&0x7f)<<8 | int(low)
+	}
+	buf := make([]byte, n)
+	err = s.fill(buf)
+	return buf, err
+}
+
+func (s *session) writeAttrs(ndx int32, iflags uint16, basisType byte, xname []byte) {
+	s.writeInt(ndx)
+	s.writeShort(iflags)
+	if iflags&itemBasisTypeFollows != 0 {
+		s.w.WriteByte(basisType)
+	}
+	if iflags&itemXnameFollows != 0 {
+		if len(xname) > 0x7f {
+			s.w.WriteByte(byte(len(xname)>>8 | 0x80))
+		}
+		s.w.WriteByte(byte(len(xname)))
+		s.w.Write(xname)
+	}
+}
+
+// 远端已有文件的块校验和，原生引擎总是发送完整的文件，读取后丢弃
+type sumHead struct {
+	count     int32
+	blength   int32
+	s2length  int32
+	remainder int32
+}
+
+func (s *session) readSumHead() (sumHead, error) {
+	head := sumHead{}
+	for _, v := range []*int32{&head.count, &head.blength, &head.s2length, &head.remainder} {
+		n, err := s.readInt()
+		if err != nil {
+			return head, err
+		}
+		*v = n
+	}
+	if head.count < 0 || head.s2length < 0 || head.s2length > 16 {
+		return head, &exitError{codeStreamIO, fmt.Errorf("invalid checksum header")}
+	}
+	return head, s.skip(int64(head.count) * int64(4+head.s2length))
+}
+
+// 以字面数据发送整个文件，最后发送带随机种子的MD4校验和。本地文件无法读取时不发送，远端会跳过该文件。
+func (client *Client) sendFile(s *session, entry *fileEntry, ndx int32, iflags uint16, basisType byte, xname []byte, head sumHead) dest.FileResult {
+	result := dest.FileResult{Path: client.relPath(entry.path), Size: entry.size}
+	file, err := os.Open(entry.path)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer file.Close()
+	s.writeAttrs(ndx, iflags, basisType, xname)
+	for _, v := range []int32{head.count, head.blength, head.s2length, head.remainder} {
+		s.writeInt(v)
+	}
+	sum := newMD4()
+	var seed [4]byte
+	seed[0], seed[1], seed[2], seed[3] = byte(s.seed), byte(s.seed>>8), byte(s.seed>>16), byte(s.seed>>24)
+	sum.Write(seed[:])
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			s.writeInt(int32(n))
+			s.w.Write(buf[:n])
+			sum.Write(buf[:n])
+			result.Sent += int64(n)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// 已经开始发送，只能结束这个文件，远端校验失败后会重新请求
+			logrus.WithError(err).Warnf("Read %s failed.", entry.path)
+			result.Err = err
+			break
+		}
+	}
+	s.writeInt(0)
+	s.w.Write(sum.Sum())
+	if err := s.w.Flush(); err != nil {
+		result.Err = s.streamError(err)
+	}
+	return result
+}
+
+func (client *Client) relPath(path string) string {
+	rel, err := filepath.Rel(client.config.RootPath, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
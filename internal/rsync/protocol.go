@@ -0,0 +1,429 @@
+package rsync
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 使用29版协议：客户端发出的数据不需要多路复用，文件列表和校验和的格式也最简单，rsync 2.6.4以后的rsyncd都支持
+const protocolVersion = 29
+
+// rsync的退出码，用于判断批量同步失败后是否需要逐个重试
+const (
+	codeStartClient = 5
+	codeSocketIO    = 10
+	codeStreamIO    = 12
+	codePartial     = 23
+	codeTimeout     = 30
+)
+
+// 原生引擎的错误，code与rsync的退出码含义相同
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.err.Error(), e.code)
+}
+
+func exitCode(err error) int {
+	var native *exitError
+	if errors.As(err, &native) {
+		return native.code
+	}
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// 多路复用的消息类型，消息头为4字节，高8位为MPLEX_BASE加类型，低24位为长度
+const (
+	mplexBase     = 7
+	msgData       = 0
+	msgErrorXfer  = 1
+	msgInfo       = 2
+	msgError      = 3
+	msgWarning    = 4
+	msgErrorUTF8  = 8
+	msgNoop       = 42
+	msgErrorExit  = 86
+	msgDeleted    = 101
+	maxMessageLen = 0xffffff
+)
+
+// 与rsyncd的一次会话
+type session struct {
+	name    string
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	in      *demux
+	timeout time.Duration
+	seed    uint32
+	sent    int64
+}
+
+// 连接rsyncd并完成握手、认证和参数的发送，args为远端rsync --server的参数
+func (client *Client) connect(ctx context.Context, args []string) (*session, error) {
+	dest := client.dest
+	port := dest.Port
+	if port <= 0 {
+		port = 873
+	}
+	dialer := net.Dialer{}
+	if dest.Timeout != "" {
+		dialer.Timeout, _ = time.ParseDuration(dest.Timeout)
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(dest.Host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, &exitError{codeSocketIO, err}
+	}
+	s := &session{name: client.Name(), conn: conn}
+	if dest.IOTimeout != "" {
+		s.timeout, _ = time.ParseDuration(dest.IOTimeout)
+	}
+	s.r = bufio.NewReaderSize(s, 64*1024)
+	s.w = bufio.NewWriterSize(s, 64*1024)
+	err = s.handshake(dest.Space, dest.Username, dest.Password, args)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// 握手阶段读取超时由连接控制，之后由demux控制，远端在接收大文件期间可以长时间没有输出
+func (s *session) Read(p []byte) (int, error) {
+	if s.timeout > 0 && s.in == nil {
+		s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+	}
+	return s.conn.Read(p)
+}
+
+func (s *session) Write(p []byte) (int, error) {
+	if s.timeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	}
+	n, err := s.conn.Write(p)
+	s.sent += int64(n)
+	return n, err
+}
+
+func (s *session) Close() {
+	s.conn.Close()
+}
+
+func (s *session) handshake(module string, username string, password string, args []string) error {
+	fmt.Fprintf(s.w, "@RSYNCD: %d.0\n", protocolVersion)
+	err := s.w.Flush()
+	if err != nil {
+		return s.streamError(err)
+	}
+	line, err := s.readLine()
+	if err != nil {
+		return s.streamError(err)
+	}
+	version, ok := strings.CutPrefix(line, "@RSYNCD: ")
+	if !ok {
+		return &exitError{codeStartClient, fmt.Errorf("unexpected greeting: %s", line)}
+	}
+	major, _, _ := strings.Cut(strings.Fields(version)[0], ".")
+	if v, err := strconv.Atoi(major); err != nil || v < protocolVersion {
+		return &exitError{codeStartClient, fmt.Errorf("protocol version %s is not supported", version)}
+	}
+
+	fmt.Fprintf(s.w, "%s\n", module)
+	err = s.w.Flush()
+	if err != nil {
+		return s.streamError(err)
+	}
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return s.streamError(err)
+		}
+		if challenge, ok := strings.CutPrefix(line, "@RSYNCD: AUTHREQD "); ok {
+			fmt.Fprintf(s.w, "%s %s\n", username, authHash(password, challenge))
+			err = s.w.Flush()
+			if err != nil {
+				return s.streamError(err)
+			}
+			continue
+		}
+		if line == "@RSYNCD: OK" {
+			break
+		}
+		if line == "@RSYNCD: EXIT" || strings.HasPrefix(line, "@ERROR") {
+			return &exitError{codeStartClient, errors.New(line)}
+		}
+		// motd
+		logrus.Debugf("rsyncd: %s", line)
+	}
+
+	for _, arg := range args {
+		fmt.Fprintf(s.w, "%s\n", arg)
+	}
+	s.w.WriteString("\n")
+	err = s.w.Flush()
+	if err != nil {
+		return s.streamError(err)
+	}
+	// 参数错误时远端在开始多路复用之前返回错误信息，否则返回4字节的校验和种子
+	if prefix, err := s.r.Peek(4); err == nil && string(prefix) == "@ERR" {
+		line, _ := s.readLine()
+		return &exitError{codeStartClient, errors.New(line)}
+	}
+	seed, err := s.readUint32(s.r)
+	if err != nil {
+		return s.streamError(err)
+	}
+	s.seed = seed
+	s.conn.SetReadDeadline(time.Time{})
+	s.in = newDemux(s.name, s.timeout)
+	go s.in.run(s.r)
+	return nil
+}
+
+func (s *session) readLine() (string, error) {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// 认证摘要为MD4(4字节的0 + 密码 + challenge)，base64编码时不补=
+func authHash(password string, challenge string) string {
+	d := newMD4()
+	d.Write([]byte{0, 0, 0, 0})
+	d.Write([]byte(password))
+	d.Write([]byte(challenge))
+	return base64.RawStdEncoding.EncodeToString(d.Sum())
+}
+
+// 连接中断或超时对应rsync的退出码，同时带上远端最后报告的错误
+func (s *session) streamError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &exitError{codeTimeout, fmt.Errorf("io timeout after %s", s.timeout)}
+	}
+	if s.in != nil {
+		if last := s.in.lastError(); last != "" {
+			err = fmt.Errorf("%s: %s", err.Error(), last)
+		}
+	}
+	if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = fmt.Errorf("connection unexpectedly closed")
+	}
+	return &exitError{codeStreamIO, err}
+}
+
+// 发送前先刷新缓冲，避免远端等待已经写入缓冲的数据
+func (s *session) fill(p []byte) error {
+	if s.w.Buffered() > 0 {
+		err := s.w.Flush()
+		if err != nil {
+			return s.streamError(err)
+		}
+	}
+	_, err := io.ReadFull(s.in, p)
+	if err != nil {
+		return s.streamError(err)
+	}
+	return nil
+}
+
+func (s *session) readUint32(r io.Reader) (uint32, error) {
+	var buf [4]byte
+	_, err := io.ReadFull(r, buf[:])
+	return binary.LittleEndian.Uint32(buf[:]), err
+}
+
+func (s *session) readInt() (int32, error) {
+	var buf [4]byte
+	err := s.fill(buf[:])
+	return int32(binary.LittleEndian.Uint32(buf[:])), err
+}
+
+func (s *session) readShort() (uint16, error) {
+	var buf [2]byte
+	err := s.fill(buf[:])
+	return binary.LittleEndian.Uint16(buf[:]), err
+}
+
+func (s *session) readByte() (byte, error) {
+	var buf [1]byte
+	err := s.fill(buf[:])
+	return buf[0], err
+}
+
+func (s *session) skip(n int64) error {
+	if s.w.Buffered() > 0 {
+		err := s.w.Flush()
+		if err != nil {
+			return s.streamError(err)
+		}
+	}
+	_, err := io.CopyN(io.Discard, s.in, n)
+	if err != nil {
+		return s.streamError(err)
+	}
+	return nil
+}
+
+func (s *session) writeInt(v int32) {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(v))
+	s.w.Write(buf[:])
+}
+
+func (s *session) writeShort(v uint16) {
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], v)
+	s.w.Write(buf[:])
+}
+
+// 超过int32范围的长度先写入-1再写入8字节
+func (s *session) writeLong(v int64) {
+	if v >= 0 && v <= 0x7fffffff {
+		s.writeInt(int32(v))
+		return
+	}
+	var buf [12]byte
+	binary.LittleEndian.PutUint32(buf[:4], 0xffffffff)
+	binary.LittleEndian.PutUint64(buf[4:], uint64(v))
+	s.w.Write(buf[:])
+}
+
+// 接收方向的多路复用流，由独立的协程读取，避免发送大文件时远端因输出阻塞而停止接收
+type demux struct {
+	name    string
+	timeout time.Duration
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     []byte
+	err     error
+	errors  []string
+}
+
+func newDemux(name string, timeout time.Duration) *demux {
+	d := &demux{name: name, timeout: timeout}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+func (d *demux) run(r io.Reader) {
+	var header [4]byte
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err != nil {
+			d.fail(err)
+			return
+		}
+		tag := binary.LittleEndian.Uint32(header[:])
+		code := int(tag>>24) - mplexBase
+		data := make([]byte, tag&maxMessageLen)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			d.fail(err)
+			return
+		}
+		if code < 0 {
+			d.fail(fmt.Errorf("unexpected tag %d", tag>>24))
+			return
+		}
+		d.message(code, data)
+	}
+}
+
+func (d *demux) message(code int, data []byte) {
+	text := strings.TrimRight(string(data), "\n")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch code {
+	case msgData:
+		d.buf = append(d.buf, data...)
+		d.cond.Broadcast()
+	case msgErrorXfer, msgError, msgErrorUTF8:
+		logrus.Errorf("rsyncd of %s: %s", d.name, text)
+		d.errors = append(d.errors, text)
+	case msgWarning:
+		logrus.Warnf("rsyncd of %s: %s", d.name, text)
+	case msgInfo:
+		logrus.Infof("rsyncd of %s: %s", d.name, text)
+	case msgDeleted:
+		logrus.Infof("Deleted %s on %s.", text, d.name)
+	case msgErrorExit:
+		d.errors = append(d.errors, "remote exited with error")
+	case msgNoop:
+	default:
+		logrus.Debugf("rsyncd of %s: message %d: %s", d.name, code, text)
+	}
+}
+
+func (d *demux) fail(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.err = err
+	d.cond.Broadcast()
+}
+
+// 等待数据超过timeout时返回os.ErrDeadlineExceeded
+func (d *demux) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	expired := false
+	if len(d.buf) == 0 && d.err == nil && d.timeout > 0 {
+		timer := time.AfterFunc(d.timeout, func() {
+			d.mu.Lock()
+			expired = true
+			d.cond.Broadcast()
+			d.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+	for len(d.buf) == 0 && d.err == nil && !expired {
+		d.cond.Wait()
+	}
+	if len(d.buf) == 0 {
+		if d.err == nil {
+			return 0, os.ErrDeadlineExceeded
+		}
+		return 0, d.err
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// 远端报告的错误，有错误时同步结果为部分失败
+func (d *demux) failures() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.errors
+}
+
+func (d *demux) lastError() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.errors) == 0 {
+		return ""
+	}
+	return d.errors[len(d.errors)-1]
+}
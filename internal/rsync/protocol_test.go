@@ -0,0 +1,94 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// 按多路复用的格式写入一条消息
+func writeFrame(w *bytes.Buffer, code int, data string) {
+	var header [4]byte
+	binary.LittleEndian.PutUint32(header[:], uint32(mplexBase+code)<<24|uint32(len(data)))
+	w.Write(header[:])
+	w.WriteString(data)
+}
+
+func TestDemux(t *testing.T) {
+	var stream bytes.Buffer
+	writeFrame(&stream, msgData, "hello")
+	writeFrame(&stream, msgInfo, "some info\n")
+	writeFrame(&stream, msgNoop, "")
+	writeFrame(&stream, msgError, "rsync: open failed\n")
+	writeFrame(&stream, msgData, "")
+	writeFrame(&stream, msgData, ", world")
+	writeFrame(&stream, msgDeleted, "old.txt")
+	writeFrame(&stream, msgErrorXfer, "rsync: write failed\n")
+	d := newDemux("test", 0)
+	d.run(&stream)
+	data, err := io.ReadAll(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello, world" {
+		t.Errorf("data = %q", data)
+	}
+	if errs := d.failures(); len(errs) != 2 || errs[0] != "rsync: open failed" {
+		t.Errorf("failures = %q", errs)
+	}
+	if d.lastError() != "rsync: write failed" {
+		t.Errorf("last error = %q", d.lastError())
+	}
+}
+
+func TestDemuxErrors(t *testing.T) {
+	// 消息类型小于MPLEX_BASE的数据不是多路复用的格式
+	d := newDemux("test", 0)
+	d.run(bytes.NewReader([]byte{5, 0, 0, 1, 'x'}))
+	if _, err := d.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Errorf("read invalid tag: %v", err)
+	}
+
+	// 消息被截断
+	var stream bytes.Buffer
+	writeFrame(&stream, msgData, "hello")
+	d = newDemux("test", 0)
+	d.run(bytes.NewReader(stream.Bytes()[:6]))
+	if _, err := d.Read(make([]byte, 1)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("read truncated frame: %v", err)
+	}
+
+	// 超时没有数据
+	d = newDemux("test", 50*time.Millisecond)
+	r, w := io.Pipe()
+	defer w.Close()
+	go d.run(r)
+	if _, err := d.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read without data: %v", err)
+	}
+}
+
+func TestWriteLong(t *testing.T) {
+	tests := []struct {
+		v    int64
+		want []byte
+	}{
+		{5, []byte{5, 0, 0, 0}},
+		{0x7fffffff, []byte{0xff, 0xff, 0xff, 0x7f}},
+		{1 << 32, []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		s := &session{w: bufio.NewWriter(&buf)}
+		s.writeLong(test.v)
+		s.w.Flush()
+		if !bytes.Equal(buf.Bytes(), test.want) {
+			t.Errorf("writeLong(%d) = %v, want %v", test.v, buf.Bytes(), test.want)
+		}
+	}
+}
@@ -1,179 +1,585 @@
 package rsync
 
 import (
+	"context"
 	"fmt"
 	"gosync/conf"
+	"gosync/internal/dest"
+	"gosync/internal/metrics"
 	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-var config *conf.RsyncConfig
-var workdir = ""
-var excludesFile = ""
-var secretFile = ""
-
-func Init(c *conf.Config) error {
-	config = &c.Rsync
-	workdir = c.Dir
-	if len(config.Excludes) > 0 {
-		excludesFile = "/tmp/rsync.excludes"
-		err := os.WriteFile(excludesFile, []byte(strings.Join(getExcludes(), "\n")), 0600)
+type Client struct {
+	config       *conf.RsyncConfig
+	dest         *conf.DestinationConfig
+	workdir      string
+	excludesFile string
+	secretFile   string
+	includesFile string
+	reporter     func(dest.FileResult)
+}
+
+func New(c *conf.RsyncConfig, d *conf.DestinationConfig, workdir string) (*Client, error) {
+	client := &Client{
+		config:  c,
+		dest:    d,
+		workdir: workdir,
+	}
+	// 每个同步目标使用独立的临时文件，避免相互覆盖
+	if len(c.Excludes) > 0 {
+		file, err := writeTempFile(client.fileName()+".excludes", strings.Join(client.getExcludes(), "\n"))
 		if err != nil {
-			return err
+			client.Close()
+			return nil, err
 		}
+		client.excludesFile = file
 	}
-	if config.Password != "" {
-		secretFile = "/tmp/rsync.secret"
-		err := os.WriteFile(secretFile, []byte(config.Password), 0600)
+	// ssh使用密钥认证，密码只用于rsyncd，原生引擎直接使用密码认证
+	if d.Password != "" && d.Transport == "rsyncd" && d.Engine == "rsync" {
+		file, err := writeTempFile(client.fileName()+".secret", d.Password)
 		if err != nil {
-			return err
+			client.Close()
+			return nil, err
 		}
+		client.secretFile = file
+	}
+	return client, nil
+}
+
+// 清理临时文件
+func (client *Client) Close() {
+	for _, file := range []string{client.excludesFile, client.secretFile, client.includesFile} {
+		if file != "" {
+			os.Remove(file)
+		}
+	}
+}
+
+func (client *Client) Name() string {
+	if client.dest.Name == "" {
+		return client.config.Name
+	}
+	return client.config.Name + "/" + client.dest.Name
+}
+
+func (client *Client) Config() *conf.RsyncConfig {
+	return client.config
+}
+
+// 设置接收单个文件同步结果的回调，rsync命令报告--out-format输出的每个变更，原生引擎报告发送的文件
+func (client *Client) SetReporter(reporter func(dest.FileResult)) {
+	client.reporter = reporter
+}
+
+func (client *Client) reportFile(result dest.FileResult) {
+	if result.Transferred() {
+		outcome := "success"
+		if result.Err != nil {
+			outcome = "failure"
+		}
+		metrics.TransferFiles.Inc(client.Name(), outcome)
+	}
+	if client.reporter != nil {
+		client.reporter(result)
 	}
-	return nil
 }
 
-func FullSync() bool {
-	options := "-av"
+// 使用原生引擎，不调用外部的rsync命令
+func (client *Client) native() bool {
+	return client.dest.Engine == "native"
+}
+
+// 获取同步目标的监听范围，返回nil表示监听整个目录
+func (client *Client) WatchFolders() ([]string, error) {
+	return GetWatchFolders(client.config, client.workdir)
+}
+
+func (client *Client) fileName() string {
+	return strings.ReplaceAll(client.Name(), "/", "-")
+}
+
+func writeTempFile(suffix string, content string) (string, error) {
+	file, err := os.CreateTemp("", "gosync-*-"+suffix)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	_, err = file.WriteString(content)
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+func (client *Client) FullSync(ctx context.Context) error {
+	if client.native() {
+		return client.nativeFullSync(ctx)
+	}
+	config := client.config
+	options := "-av" + client.metaOptions()
 	if config.Compress {
 		options += "z"
 	}
 	options += "P"
 	args := []string{options}
+	args = append(args, client.linkArgs()...)
 	if config.AllowDelete {
 		args = append(args, "--delete", "--ignore-errors")
 	}
-	if excludesFile != "" {
-		args = append(args, fmt.Sprintf("--exclude-from=%s", excludesFile))
+	if client.excludesFile != "" {
+		args = append(args, fmt.Sprintf("--exclude-from=%s", client.excludesFile))
 	}
-	includeFiles, err := getIncludes()
+	includeFiles, err := client.getIncludes()
 	if err != nil {
-		logrus.WithError(err).Error("Execute rsync failed.")
-		return false
+		return client.done("full", err)
 	} else if includeFiles != "" {
-		args = append(args, fmt.Sprintf("--include-from=%s", includeFiles), "--exclude='*'")
+		args = append(args, fmt.Sprintf("--include-from=%s", includeFiles), "--exclude=*")
+	}
+	args = append(args, client.connectArgs()...)
+	args = append(args, config.RootPath, client.remote(""))
+	return client.run(ctx, "full", args)
+}
+
+func (client *Client) Sync(ctx context.Context, path string) error {
+	if client.native() {
+		return client.nativeSync(ctx, path)
+	}
+	config := client.config
+	err := client.exists(path)
+	if err != nil {
+		logrus.Warn("Ignore rsync because path is not exists.")
+		return nil
 	}
-	if config.Port > 0 && config.Port != 873 {
-		args = append(args, fmt.Sprintf("--port=%d", config.Port))
+	options := "-av" + client.metaOptions()
+	if config.Compress {
+		options += "z"
 	}
-	if config.Timeout != "" {
-		timeout, _ := time.ParseDuration(config.Timeout)
-		args = append(args, fmt.Sprintf("--contimeout=%d", int(math.Ceil(timeout.Seconds()))))
+	args := []string{options}
+	args = append(args, client.linkArgs()...)
+	if config.AllowDelete {
+		args = append(args, "--delete", "--ignore-errors")
 	}
-	if config.IOTimeout != "" {
-		timeout, _ := time.ParseDuration(config.IOTimeout)
-		args = append(args, fmt.Sprintf("--timeout=%d", int(math.Ceil(timeout.Seconds()))))
+	if client.excludesFile != "" {
+		args = append(args, fmt.Sprintf("--exclude-from=%s", client.excludesFile))
 	}
-	args = append(args, config.RootPath, fmt.Sprintf("rsync://%s@%s/%s/", config.Username, config.Host, config.Space))
-	logrus.Debugf("Execute: rsync %s", strings.Join(args, " "))
-	if secretFile != "" {
-		args = append(args, fmt.Sprintf("--password-file=%s", secretFile))
+	args = append(args, client.connectArgs()...)
+	args = append(args, config.RootPath+path, client.remote(path))
+	return client.run(ctx, "sync", args)
+}
+
+func (client *Client) Delete(ctx context.Context, path string) error {
+	if client.native() {
+		return client.nativeDelete(ctx, path)
 	}
-	cmd := exec.Command("rsync", args...)
-	if logrus.IsLevelEnabled(logrus.DebugLevel) {
-		cmd.Stdout = logrus.StandardLogger().Out
-		cmd.Stderr = logrus.StandardLogger().Out
+	if !client.config.AllowDelete {
+		return nil
 	}
-	err = cmd.Run()
+	return client.done("delete", client.delete(ctx, []string{path}))
+}
+
+// 在远端将from重命名为to，利用远端已有的from作为基准文件，避免重新传输数据：
+// 目录通过--link-dest硬链接未变化的文件，文件通过--fuzzy以同大小同时间的文件作为基准。
+// 传输完成后再删除远端的from。
+func (client *Client) Rename(ctx context.Context, from string, to string) error {
+	if client.native() {
+		return client.nativeRename(ctx, from, to)
+	}
+	config := client.config
+	err := client.exists(to)
+	if err == nil {
+		options := "-av" + client.metaOptions()
+		if config.Compress {
+			options += "z"
+		}
+		args := []string{options}
+		args = append(args, client.linkArgs()...)
+		if strings.HasSuffix(to, "/") {
+			// --link-dest的相对路径是相对于远端目标目录的
+			rel, _ := filepath.Rel("/"+to, "/"+from)
+			args = append(args, fmt.Sprintf("--link-dest=%s", rel))
+			if config.AllowDelete {
+				args = append(args, "--delete", "--ignore-errors")
+			}
+		} else {
+			args = append(args, "--fuzzy", "--fuzzy")
+			if filepath.Dir(from) != filepath.Dir(to) {
+				rel, _ := filepath.Rel("/"+filepath.Dir(to), "/"+filepath.Dir(from))
+				args = append(args, fmt.Sprintf("--link-dest=%s", rel))
+			}
+		}
+		if client.excludesFile != "" {
+			args = append(args, fmt.Sprintf("--exclude-from=%s", client.excludesFile))
+		}
+		args = append(args, client.connectArgs()...)
+		args = append(args, config.RootPath+to, client.remote(to))
+		if err := client.run(ctx, "rename", args); err != nil {
+			return err
+		}
+	} else {
+		logrus.Warnf("Ignore rsync because path is not exists: %s", to)
+	}
+	return client.Delete(ctx, from)
+}
+
+func (client *Client) run(ctx context.Context, kind string, args []string) error {
+	return client.done(kind, client.execute(ctx, kind, args))
+}
+
+func (client *Client) done(kind string, err error) error {
 	if err != nil {
+		err = wrap(kind, err)
 		logrus.WithError(err).Error("Execute rsync failed.")
-		return false
+		return err
 	} else {
 		logrus.Info("Execute rsync successfully.")
-		return true
+		return nil
 	}
 }
 
-func Sync(path string) bool {
-	_, err := os.Stat(config.RootPath + path)
+// 按退出码区分错误是否可以通过逐个重试恢复，无法执行rsync或被信号中止时没有退出码
+func wrap(kind string, err error) error {
+	code := exitCode(err)
+	return &dest.Error{Op: kind, Code: code, Fatal: code < 0 || fatalExitCodes[code], Err: err}
+}
+
+// 所有路径的结果相同
+func resultOf(paths []string, err error) dest.Result {
 	if err != nil {
-		logrus.Warn("Ignore rsync because path is not exists.")
-		return true
+		return dest.Result{Failed: paths, Err: err}
 	}
-	options := "-av"
-	if config.Compress {
-		options += "z"
+	return dest.Result{}
+}
+
+// 执行rsync并按类型和结果计数，解析--stats和--out-format的输出，逐个报告文件的变更并计入指标
+func (client *Client) execute(ctx context.Context, kind string, args []string) error {
+	logrus.Debugf("Execute: rsync %s", strings.Join(args, " "))
+	base := client.sourceDir(args)
+	args = append([]string{"--stats", outFormat}, args...)
+	if client.secretFile != "" {
+		args = append(args, fmt.Sprintf("--password-file=%s", client.secretFile))
+	}
+	stats := &statsWriter{report: func(change Change) {
+		path := base
+		if change.Name != "./" {
+			path += change.Name
+		}
+		client.reportFile(dest.FileResult{Path: path, Size: change.Size, Sent: change.Sent, Change: change.Code})
+	}}
+	cmd := client.command(ctx, args)
+	cmd.Stdout = stats
+	err := cmd.Run()
+	stats.Close()
+	outcome := "success"
+	if ctx.Err() != nil {
+		outcome = "aborted"
+	} else if err != nil {
+		outcome = "failure"
+	}
+	metrics.RsyncRuns.Inc(client.Name(), kind, outcome)
+	client.record(kind, &stats.stats)
+	return err
+}
+
+// 传输的源路径相对于root-path的目录，rsync输出的文件名相对于这个目录
+func (client *Client) sourceDir(args []string) string {
+	if len(args) < 2 {
+		return ""
 	}
-	args := []string{options}
-	if config.AllowDelete {
-		args = append(args, "--delete", "--ignore-errors")
+	dir := strings.TrimPrefix(args[len(args)-2], client.config.RootPath)
+	if !strings.HasSuffix(dir, "/") {
+		dir = filepath.Dir(dir) + "/"
 	}
-	if excludesFile != "" {
-		args = append(args, fmt.Sprintf("--exclude-from=%s", excludesFile))
+	return strings.TrimPrefix(dir, "./")
+}
+
+// 一次rsync执行的统计计入指标并输出到日志，单个文件的变更在解析时已经报告
+func (client *Client) record(kind string, stats *Stats) {
+	if stats.Sent > 0 {
+		metrics.RsyncSentBytes.Add(float64(stats.Sent), client.Name())
 	}
-	if config.Port > 0 && config.Port != 873 {
-		args = append(args, fmt.Sprintf("--port=%d", config.Port))
+	if stats.Literal > 0 {
+		metrics.RsyncLiteralBytes.Add(float64(stats.Literal), client.Name())
 	}
-	if config.Timeout != "" {
-		timeout, _ := time.ParseDuration(config.Timeout)
-		args = append(args, fmt.Sprintf("--contimeout=%d", int(math.Ceil(timeout.Seconds()))))
+	if stats.Matched > 0 {
+		metrics.RsyncMatchedBytes.Add(float64(stats.Matched), client.Name())
 	}
-	args = append(args, config.RootPath+path, fmt.Sprintf("rsync://%s@%s/%s/%s", config.Username, config.Host, config.Space, path))
-	logrus.Debugf("Execute: rsync %s", strings.Join(args, " "))
-	if secretFile != "" {
-		args = append(args, fmt.Sprintf("--password-file=%s", secretFile))
+	if stats.Deleted > 0 {
+		metrics.RsyncDeletedFiles.Add(float64(stats.Deleted), client.Name())
 	}
-	cmd := exec.Command("rsync", args...)
+	logrus.Infof("Rsync %s of %s: %d files transferred, %d deleted, %d bytes sent (%d literal, %d matched), %d bytes received.",
+		kind, client.Name(), stats.Files, stats.Deleted, stats.Sent, stats.Literal, stats.Matched, stats.Received)
+}
+
+// 取消时先向rsync发送SIGTERM，使其通知远端清理未完成的临时文件，超时后再强制结束
+const cancelWaitDelay = 10 * time.Second
+
+func (client *Client) command(ctx context.Context, args []string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "rsync", args...)
+	cmd.Cancel = func() error {
+		logrus.Warnf("Abort rsync of %s.", client.Name())
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = cancelWaitDelay
 	if logrus.IsLevelEnabled(logrus.DebugLevel) {
-		cmd.Stdout = logrus.StandardLogger().Out
 		cmd.Stderr = logrus.StandardLogger().Out
 	}
-	err = cmd.Run()
+	return cmd
+}
+
+// 连接失败等错误码，此时逐个重试也不会成功
+var fatalExitCodes = map[int]bool{5: true, 10: true, 12: true, 30: true, 35: true}
+
+// 用一次rsync调用同步多个路径，返回同步失败的路径
+func (client *Client) SyncFiles(ctx context.Context, paths []string) dest.Result {
+	if client.native() {
+		return client.nativeSyncFiles(ctx, client.existing(paths))
+	}
+	config := client.config
+	files := client.existing(paths)
+	if len(files) == 0 {
+		return dest.Result{}
+	}
+	filesFrom, err := writeTempFile(client.fileName()+".files", strings.Join(files, "\n"))
 	if err != nil {
-		logrus.WithError(err).Error("Execute rsync failed.")
-		return false
-	} else {
-		logrus.Info("Execute rsync successfully.")
-		return true
+		return resultOf(paths, client.done("sync", err))
 	}
+	defer os.Remove(filesFrom)
+	options := "-avr" + client.metaOptions()
+	if config.Compress {
+		options += "z"
+	}
+	args := []string{options, fmt.Sprintf("--files-from=%s", filesFrom)}
+	args = append(args, client.linkArgs()...)
+	if config.AllowDelete {
+		args = append(args, "--delete", "--ignore-errors")
+	}
+	if client.excludesFile != "" {
+		args = append(args, fmt.Sprintf("--exclude-from=%s", client.excludesFile))
+	}
+	args = append(args, client.connectArgs()...)
+	args = append(args, config.RootPath, client.remote(""))
+	return client.runBatch(ctx, "sync", client.execute(ctx, "sync", args), files, client.Sync)
 }
 
-func Delete(path string) bool {
+// 用一次rsync调用删除多个远端路径，返回删除失败的路径
+func (client *Client) DeleteFiles(ctx context.Context, paths []string) dest.Result {
+	config := client.config
 	if !config.AllowDelete {
-		return true
+		return dest.Result{}
+	}
+	if client.native() {
+		return client.nativeDeleteFiles(ctx, paths)
+	}
+	return client.runBatch(ctx, "delete", client.delete(ctx, paths), paths, client.Delete)
+}
+
+// 只遍历被删除路径的上级目录，其余路径都被排除从而不会被删除
+func (client *Client) delete(ctx context.Context, paths []string) error {
+	rules := []string{}
+	parents := map[string]bool{}
+	for _, path := range paths {
+		name := "/" + strings.TrimSuffix(path, "/")
+		for dir := filepath.Dir(name); dir != "/" && !parents[dir]; dir = filepath.Dir(dir) {
+			parents[dir] = true
+			rules = append(rules, "+ "+dir+"/")
+		}
+		rules = append(rules, "+ "+name, "+ "+name+"/***")
 	}
-	parent := filepath.Dir(path) + "/"
-	if strings.HasSuffix(path, "/") {
-		parent = filepath.Dir(path[:len(path)-1]) + "/"
+	rules = append(rules, "- *")
+	filterFile, err := writeTempFile(client.fileName()+".filter", strings.Join(rules, "\n"))
+	if err != nil {
+		return err
 	}
+	defer os.Remove(filterFile)
 	args := []string{"-av", "--delete", "--ignore-errors"}
-	if excludesFile != "" {
-		args = append(args, fmt.Sprintf("--exclude-from=%s", excludesFile))
+	if client.excludesFile != "" {
+		args = append(args, fmt.Sprintf("--exclude-from=%s", client.excludesFile))
 	}
-	args = append(args, fmt.Sprintf("--include='%s'", filepath.Base(path)), "--exclude='*'")
-	if config.Port > 0 && config.Port != 873 {
-		args = append(args, fmt.Sprintf("--port=%d", config.Port))
+	args = append(args, fmt.Sprintf("--filter=merge %s", filterFile))
+	args = append(args, client.connectArgs()...)
+	args = append(args, client.config.RootPath, client.remote(""))
+	return client.execute(ctx, "delete", args)
+}
+
+// 只同步权限、属主和修改时间等属性。--size-only使大小没有变化的文件不会重新传输内容，
+// --existing不会创建远端还不存在的文件，这些文件由内容的同步任务负责。
+func (client *Client) SyncAttrs(ctx context.Context, paths []string) dest.Result {
+	if client.native() {
+		return client.nativeSyncAttrs(ctx, client.existing(paths))
+	}
+	config := client.config
+	files := client.existing(paths)
+	if len(files) == 0 {
+		return dest.Result{}
+	}
+	filesFrom, err := writeTempFile(client.fileName()+".files", strings.Join(files, "\n"))
+	if err != nil {
+		return resultOf(paths, client.done("attrib", err))
+	}
+	defer os.Remove(filesFrom)
+	args := []string{"-dlpogtv" + client.metaOptions(), "--size-only", "--existing", fmt.Sprintf("--files-from=%s", filesFrom)}
+	args = append(args, client.linkArgs()...)
+	args = append(args, client.connectArgs()...)
+	args = append(args, config.RootPath, client.remote(""))
+	if len(files) == 1 {
+		return resultOf(files, client.run(ctx, "attrib", args))
+	}
+	return client.runBatch(ctx, "attrib", client.execute(ctx, "attrib", args), files, func(ctx context.Context, path string) error {
+		return client.SyncAttrs(ctx, []string{path}).Err
+	})
+}
+
+// 过滤掉本地已不存在的路径
+func (client *Client) existing(paths []string) []string {
+	files := []string{}
+	for _, path := range paths {
+		err := client.exists(path)
+		if err != nil {
+			logrus.Warnf("Ignore rsync because path is not exists: %s", path)
+			continue
+		}
+		files = append(files, path)
 	}
-	if config.Timeout != "" {
-		timeout, _ := time.ParseDuration(config.Timeout)
-		args = append(args, fmt.Sprintf("--contimeout=%d", int(math.Ceil(timeout.Seconds()))))
+	return files
+}
+
+// 按符号链接策略判断本地路径是否存在，follow时失效的链接视为不存在
+func (client *Client) exists(path string) error {
+	var err error
+	if client.config.Symlinks == "follow" {
+		_, err = os.Stat(client.config.RootPath + path)
+	} else {
+		_, err = os.Lstat(client.config.RootPath + path)
 	}
-	args = append(args, config.RootPath+parent, fmt.Sprintf("rsync://%s@%s/%s/%s", config.Username, config.Host, config.Space, parent))
-	logrus.Debugf("Execute: rsync %s", strings.Join(args, " "))
-	if secretFile != "" {
-		args = append(args, fmt.Sprintf("--password-file=%s", secretFile))
+	return err
+}
+
+// 符号链接策略对应的参数，copy即-a中的-l
+func (client *Client) linkArgs() []string {
+	switch client.config.Symlinks {
+	case "follow":
+		return []string{"--copy-links"}
+	case "skip":
+		return []string{"--no-links"}
 	}
-	cmd := exec.Command("rsync", args...)
-	if logrus.IsLevelEnabled(logrus.DebugLevel) {
-		cmd.Stdout = logrus.StandardLogger().Out
-		cmd.Stderr = logrus.StandardLogger().Out
+	return nil
+}
+
+// 按配置同步扩展属性和ACL
+func (client *Client) metaOptions() string {
+	options := ""
+	if client.config.Xattrs {
+		options += "X"
 	}
-	err := cmd.Run()
-	if err != nil {
-		logrus.WithError(err).Error("Execute rsync failed.")
-		return false
+	if client.config.Acls {
+		options += "A"
+	}
+	return options
+}
+
+// 远端路径，rsyncd为rsync://user@host/space/path，ssh为user@host:remote-path/path，local为remote-path/path
+func (client *Client) remote(path string) string {
+	dest := client.dest
+	switch dest.Transport {
+	case "ssh":
+		return fmt.Sprintf("%s@%s:%s%s", dest.Username, dest.Host, dest.RemotePath, path)
+	case "local":
+		return dest.RemotePath + path
+	}
+	return fmt.Sprintf("rsync://%s@%s/%s/%s", dest.Username, dest.Host, dest.Space, path)
+}
+
+func (client *Client) connectArgs() []string {
+	dest := client.dest
+	args := []string{}
+	if dest.Transport == "local" {
+		return args
+	}
+	if dest.Transport == "ssh" {
+		args = append(args, "-e", client.sshCommand())
 	} else {
-		logrus.Info("Execute rsync successfully.")
-		return true
+		if dest.Port > 0 && dest.Port != 873 {
+			args = append(args, fmt.Sprintf("--port=%d", dest.Port))
+		}
+		if dest.Timeout != "" {
+			timeout, _ := time.ParseDuration(dest.Timeout)
+			args = append(args, fmt.Sprintf("--contimeout=%d", int(math.Ceil(timeout.Seconds()))))
+		}
 	}
+	if dest.IOTimeout != "" {
+		timeout, _ := time.ParseDuration(dest.IOTimeout)
+		args = append(args, fmt.Sprintf("--timeout=%d", int(math.Ceil(timeout.Seconds()))))
+	}
+	return args
+}
+
+// rsync -e使用的ssh命令，BatchMode避免等待输入密码，配置known-hosts时只信任其中的主机密钥
+func (client *Client) sshCommand() string {
+	dest := client.dest
+	ssh := []string{"ssh", "-o", "BatchMode=yes"}
+	if dest.Port > 0 && dest.Port != 22 {
+		ssh = append(ssh, "-p", strconv.Itoa(dest.Port))
+	}
+	if dest.IdentityFile != "" {
+		ssh = append(ssh, "-i", quote(client.absPath(dest.IdentityFile)))
+	}
+	if dest.KnownHosts != "" {
+		ssh = append(ssh, "-o", quote("UserKnownHostsFile="+client.absPath(dest.KnownHosts)), "-o", "StrictHostKeyChecking=yes")
+	}
+	if dest.Timeout != "" {
+		timeout, _ := time.ParseDuration(dest.Timeout)
+		ssh = append(ssh, "-o", fmt.Sprintf("ConnectTimeout=%d", int(math.Ceil(timeout.Seconds()))))
+	}
+	return strings.Join(ssh, " ")
+}
+
+// 相对路径相对于配置文件所在目录
+func (client *Client) absPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(client.workdir, path)
+}
+
+// rsync按空白拆分-e的命令，路径中可能包含空格，使用单引号包裹
+func quote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'"'"'`) + "'"
+}
+
+// 批量rsync的结果，部分失败时逐个路径重试以确定失败的路径
+func (client *Client) runBatch(ctx context.Context, kind string, err error, paths []string, single func(context.Context, string) error) dest.Result {
+	if err == nil {
+		logrus.Infof("Execute rsync successfully. (%d paths)", len(paths))
+		return dest.Result{}
+	}
+	err = wrap(kind, err)
+	logrus.WithError(err).Error("Execute rsync failed.")
+	// 被取消或只有一个路径时不再逐个重试
+	if dest.IsFatal(err) || ctx.Err() != nil || len(paths) == 1 {
+		return dest.Result{Failed: paths, Err: err}
+	}
+	logrus.Infof("Retry %d paths one by one to find out the failed ones...", len(paths))
+	result := dest.Result{}
+	for _, path := range paths {
+		if err := single(ctx, path); err != nil {
+			result.Fail(path, err)
+		}
+	}
+	return result
 }
 
-func GetWatchFolders() ([]string, error) {
+// 获取同步目标的监听范围，返回nil表示监听整个目录
+func GetWatchFolders(config *conf.RsyncConfig, workdir string) ([]string, error) {
 	if config.WatchScopeEval == "" {
 		return nil, nil
 	}
@@ -210,22 +616,28 @@ func GetWatchFolders() ([]string, error) {
 	}
 }
 
-func getIncludes() (string, error) {
-	folders, err := GetWatchFolders()
+func (client *Client) getIncludes() (string, error) {
+	folders, err := GetWatchFolders(client.config, client.workdir)
 	if err != nil {
 		return "", err
 	} else if folders == nil {
 		return "", nil
 	} else {
-		includesFile := "/tmp/rsync.includes"
-		err := os.WriteFile(includesFile, []byte(strings.Join(folders, "\n")), 0600)
-		return includesFile, err
+		if client.includesFile == "" {
+			file, err := writeTempFile(client.fileName()+".includes", "")
+			if err != nil {
+				return "", err
+			}
+			client.includesFile = file
+		}
+		err := os.WriteFile(client.includesFile, []byte(strings.Join(folders, "\n")), 0600)
+		return client.includesFile, err
 	}
 }
 
-func getExcludes() []string {
+func (client *Client) getExcludes() []string {
 	args := []string{}
-	for _, exclude := range config.Excludes {
+	for _, exclude := range client.config.Excludes {
 		exclude = strings.TrimPrefix(exclude, "/")
 		pattern := ""
 		parts := strings.Split(exclude, "/")
@@ -0,0 +1,183 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"gosync/conf"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 在临时目录上启动rsyncd，返回模块的目录和端口，没有安装rsync时跳过
+func startRsyncd(t *testing.T) (string, int) {
+	t.Helper()
+	rsync, err := exec.LookPath("rsync")
+	if err != nil {
+		t.Skip("rsync not installed")
+	}
+	dir := t.TempDir()
+	module := filepath.Join(dir, "module")
+	if err := os.Mkdir(module, 0755); err != nil {
+		t.Fatal(err)
+	}
+	secrets := filepath.Join(dir, "secrets")
+	if err := os.WriteFile(secrets, []byte("gosync:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "rsyncd.conf")
+	content := fmt.Sprintf("use chroot = no\npid file = %s\nuid = %d\ngid = %d\n\n[data]\npath = %s\nread only = no\nauth users = gosync\nsecrets file = %s\n",
+		filepath.Join(dir, "rsyncd.pid"), os.Getuid(), os.Getgid(), module, secrets)
+	if err := os.WriteFile(config, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	var output bytes.Buffer
+	cmd := exec.Command(rsync, "--daemon", "--no-detach", "--config="+config, "--address=127.0.0.1", fmt.Sprintf("--port=%d", port))
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rsyncd not started: %s", output.String())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return module + "/", port
+}
+
+// 目录树中所有的路径和文件内容
+func snapshot(t *testing.T, root string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == filepath.Clean(root) {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if info.IsDir() {
+			files[rel+"/"] = ""
+		} else {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			files[rel] = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func keys(files map[string]string) string {
+	list := []string{}
+	for key := range files {
+		list = append(list, key)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
+
+// 使用rsync命令和原生引擎分别同步、删除和重命名，远端的目录树与本地保持一致
+func TestRsyncdRoundTrip(t *testing.T) {
+	for _, engine := range []string{"rsync", "native"} {
+		t.Run(engine, func(t *testing.T) {
+			remote, port := startRsyncd(t)
+			root := t.TempDir() + "/"
+			c := &conf.RsyncConfig{Name: "data", RootPath: root, AllowDelete: true, Excludes: []string{"*.tmp"}, Symlinks: "copy"}
+			d := &conf.DestinationConfig{RemoteConfig: conf.RemoteConfig{
+				Host: "127.0.0.1", Port: port, Username: "gosync", Password: "secret", Space: "data",
+				Transport: "rsyncd", Engine: engine, Timeout: "5s", IOTimeout: "10s",
+			}}
+			client, err := New(c, d, root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			ctx := context.Background()
+			check := func(step string) {
+				t.Helper()
+				local, got := snapshot(t, root), snapshot(t, remote)
+				for path := range local {
+					if strings.HasSuffix(path, ".tmp") {
+						delete(local, path)
+					}
+				}
+				if keys(got) != keys(local) {
+					t.Fatalf("%s: remote has %s, want %s", step, keys(got), keys(local))
+				}
+				for path, data := range local {
+					if got[path] != data {
+						t.Errorf("%s: %s differs", step, path)
+					}
+				}
+			}
+			write := func(path string, data string) {
+				t.Helper()
+				os.MkdirAll(filepath.Dir(root+path), 0755)
+				if err := os.WriteFile(root+path, []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			write("a.txt", "a")
+			write("dir/b c.txt", strings.Repeat("b", 100000))
+			write("dir/sub/d.txt", "d")
+			write("skip.tmp", "tmp")
+			if err := client.FullSync(ctx); err != nil {
+				t.Fatal(err)
+			}
+			check("full sync")
+
+			write("a.txt", "changed")
+			write("dir/new.txt", "new")
+			if result := client.SyncFiles(ctx, []string{"a.txt", "dir/new.txt"}); !result.OK() {
+				t.Fatal(result.Err)
+			}
+			check("sync")
+
+			os.Remove(root + "a.txt")
+			os.RemoveAll(root + "dir/sub")
+			if result := client.DeleteFiles(ctx, []string{"a.txt", "dir/sub/"}); !result.OK() {
+				t.Fatal(result.Err)
+			}
+			check("delete")
+
+			os.Rename(root+"dir", root+"moved")
+			if err := client.Rename(ctx, "dir/", "moved/"); err != nil {
+				t.Fatal(err)
+			}
+			check("rename folder")
+			os.Rename(root+"moved/b c.txt", root+"moved/e.txt")
+			if err := client.Rename(ctx, "moved/b c.txt", "moved/e.txt"); err != nil {
+				t.Fatal(err)
+			}
+			check("rename file")
+		})
+	}
+}
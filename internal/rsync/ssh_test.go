@@ -0,0 +1,121 @@
+package rsync
+
+import (
+	"gosync/conf"
+	"reflect"
+	"testing"
+)
+
+// 按rsync拆分-e命令的规则(do_cmd)拆分参数：只按空格分隔，单引号和双引号中的空格不分隔，引号中连续两个引号表示引号本身
+func splitRsyncCommand(t *testing.T, cmd string) []string {
+	t.Helper()
+	args := []string{}
+	for i := 0; i < len(cmd); i++ {
+		if cmd[i] == ' ' {
+			continue
+		}
+		arg := []byte{}
+		var inQuote byte
+		for ; i < len(cmd) && (cmd[i] != ' ' || inQuote != 0); i++ {
+			if c := cmd[i]; c == '\'' || c == '"' {
+				if inQuote == 0 {
+					inQuote = c
+					continue
+				}
+				if c == inQuote {
+					if i+1 < len(cmd) && cmd[i+1] == inQuote {
+						i++
+					} else {
+						inQuote = 0
+						continue
+					}
+				}
+			}
+			arg = append(arg, cmd[i])
+		}
+		if inQuote != 0 {
+			t.Fatalf("unbalanced quotes in %q", cmd)
+		}
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func TestSSHCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		workdir string
+		dest    conf.RemoteConfig
+		want    []string
+	}{
+		{
+			name: "defaults",
+			dest: conf.RemoteConfig{Port: 22},
+			want: []string{"ssh", "-o", "BatchMode=yes"},
+		},
+		{
+			name: "port and timeout",
+			dest: conf.RemoteConfig{Port: 2222, Timeout: "1500ms"},
+			want: []string{"ssh", "-o", "BatchMode=yes", "-p", "2222", "-o", "ConnectTimeout=2"},
+		},
+		{
+			name:    "relative paths with spaces",
+			workdir: "/etc/go sync",
+			dest:    conf.RemoteConfig{IdentityFile: "keys/id ed25519", KnownHosts: "known hosts"},
+			want: []string{"ssh", "-o", "BatchMode=yes", "-i", "/etc/go sync/keys/id ed25519",
+				"-o", "UserKnownHostsFile=/etc/go sync/known hosts", "-o", "StrictHostKeyChecking=yes"},
+		},
+		{
+			name:    "absolute paths with quotes",
+			workdir: "/etc/gosync",
+			dest:    conf.RemoteConfig{IdentityFile: `/home/o'brien/.ssh/"id"`, KnownHosts: `/home/o'brien/it's known`},
+			want: []string{"ssh", "-o", "BatchMode=yes", "-i", `/home/o'brien/.ssh/"id"`,
+				"-o", `UserKnownHostsFile=/home/o'brien/it's known`, "-o", "StrictHostKeyChecking=yes"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &Client{dest: &conf.DestinationConfig{RemoteConfig: test.dest}, workdir: test.workdir}
+			if got := splitRsyncCommand(t, client.sshCommand()); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("sshCommand() = %q, parsed as %q, want %q", client.sshCommand(), got, test.want)
+			}
+		})
+	}
+}
+
+func TestConnectArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		dest conf.RemoteConfig
+		want []string
+	}{
+		{
+			name: "local",
+			dest: conf.RemoteConfig{Transport: "local", IOTimeout: "30s"},
+			want: []string{},
+		},
+		{
+			name: "rsyncd",
+			dest: conf.RemoteConfig{Transport: "rsyncd", Port: 8873, Timeout: "10s", IOTimeout: "30s"},
+			want: []string{"--port=8873", "--contimeout=10", "--timeout=30"},
+		},
+		{
+			name: "rsyncd default port",
+			dest: conf.RemoteConfig{Transport: "rsyncd", Port: 873},
+			want: []string{},
+		},
+		{
+			name: "ssh",
+			dest: conf.RemoteConfig{Transport: "ssh", Port: 22, IdentityFile: "/keys/my key", IOTimeout: "1m"},
+			want: []string{"-e", "ssh -o BatchMode=yes -i '/keys/my key'", "--timeout=60"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &Client{dest: &conf.DestinationConfig{RemoteConfig: test.dest}}
+			if got := client.connectArgs(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("connectArgs() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package rsync
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// 每个变更输出一行：变更代码、文件大小、发送的字节数、文件名，符号链接和硬链接还有指向的目标
+const outFormat = "--out-format=%i %l %b %n%L"
+
+// 一次rsync执行的结果，取自--stats和--out-format的输出
+type Stats struct {
+	// 传输了内容的普通文件数
+	Files int
+	// 远端删除的文件数
+	Deleted int
+	// 发送和接收的字节数
+	Sent     int64
+	Received int64
+	// 直接发送的文件数据和与远端已有数据匹配而不需要发送的文件数据
+	Literal int64
+	Matched int64
+}
+
+// 单个文件的变更，Code与--itemize-changes的格式相同，如">f.st......"、"cd+++++++++"、"*deleting"，
+// Name相对于传输的源目录，Sent为发送的字节数
+type Change struct {
+	Code string
+	Name string
+	Size int64
+	Sent int64
+}
+
+func (change Change) Deleted() bool {
+	return change.Code == "*deleting"
+}
+
+// 逐行解析rsync的标准输出，每个变更解析后立即交给report，只保留统计数据
+type statsWriter struct {
+	line   []byte
+	stats  Stats
+	report func(Change)
+}
+
+// 文件名最长4096字节，超长的行只可能是无法解析的内容
+const maxLineLength = 8192
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			if len(w.line) < maxLineLength {
+				w.line = append(w.line, p[:min(len(p), maxLineLength-len(w.line))]...)
+			}
+			break
+		}
+		if len(w.line) < maxLineLength {
+			w.line = append(w.line, p[:min(i, maxLineLength-len(w.line))]...)
+		}
+		w.parse(string(w.line))
+		w.line = w.line[:0]
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+func (w *statsWriter) Close() {
+	if len(w.line) > 0 {
+		w.parse(string(w.line))
+		w.line = w.line[:0]
+	}
+}
+
+func (w *statsWriter) parse(line string) {
+	if change, ok := parseChange(line); ok {
+		if change.Deleted() {
+			w.stats.Deleted++
+		}
+		if w.report != nil {
+			w.report(change)
+		}
+		return
+	}
+	name, value, ok := strings.Cut(line, ": ")
+	if !ok {
+		return
+	}
+	switch name {
+	// 3.1之前为Number of files transferred
+	case "Number of regular files transferred", "Number of files transferred":
+		w.stats.Files = int(parseNumber(value))
+	case "Literal data":
+		w.stats.Literal = parseNumber(value)
+	case "Matched data":
+		w.stats.Matched = parseNumber(value)
+	case "Total bytes sent":
+		w.stats.Sent = parseNumber(value)
+	case "Total bytes received":
+		w.stats.Received = parseNumber(value)
+	}
+}
+
+// 解析"1,234 bytes"形式的数字
+func parseNumber(value string) int64 {
+	value, _, _ = strings.Cut(strings.TrimSpace(value), " ")
+	n, _ := strconv.ParseInt(strings.ReplaceAll(value, ",", ""), 10, 64)
+	return n
+}
+
+// 解析--out-format输出的一行，变更代码固定为11个字符，删除为"*deleting  "
+func parseChange(line string) (Change, bool) {
+	if len(line) < 14 || line[11] != ' ' {
+		return Change{}, false
+	}
+	code := line[:11]
+	if strings.HasPrefix(code, "*deleting") {
+		code = "*deleting"
+	} else if !strings.ContainsRune("<>ch.", rune(code[0])) || !strings.ContainsRune("fdLDS", rune(code[1])) {
+		return Change{}, false
+	}
+	fields := strings.SplitN(line[12:], " ", 3)
+	if len(fields) < 3 {
+		return Change{}, false
+	}
+	size, err := strconv.ParseInt(strings.ReplaceAll(fields[0], ",", ""), 10, 64)
+	if err != nil {
+		return Change{}, false
+	}
+	sent, err := strconv.ParseInt(strings.ReplaceAll(fields[1], ",", ""), 10, 64)
+	if err != nil {
+		return Change{}, false
+	}
+	name := fields[2]
+	if code[1] == 'L' {
+		name, _, _ = strings.Cut(name, " -> ")
+	} else if code[0] == 'h' {
+		name, _, _ = strings.Cut(name, " => ")
+	}
+	return Change{Code: code, Name: unescape(name), Size: size, Sent: sent}, true
+}
+
+// rsync将文件名中不可打印的字符输出为\#ooo
+func unescape(name string) string {
+	if !strings.Contains(name, `\#`) {
+		return name
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' && i+4 < len(name) && name[i+1] == '#' {
+			if c, err := strconv.ParseUint(name[i+2:i+5], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 4
+				continue
+			}
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
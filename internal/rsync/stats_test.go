@@ -0,0 +1,64 @@
+package rsync
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStatsWriter(t *testing.T) {
+	output := "sending incremental file list\n" +
+		".d..t...... 4,096 0 ./\n" +
+		">f+++++++++ 1,234 1,300 a.txt\n" +
+		"cL+++++++++ 5 0 link -> a.txt\n" +
+		"cd+++++++++ 4096 0 dir with space/\n" +
+		">f.st...... 20 12 dir with space/b c\n" +
+		"*deleting   0 0 gone\n" +
+		"hf+++++++++ 1234 0 hard => a.txt\n" +
+		">f+++++++++ 3 3 tab\\#011name\n" +
+		"\n" +
+		"Number of files: 5 (reg: 3, dir: 2)\n" +
+		"Number of deleted files: 1 (reg: 1)\n" +
+		"Number of regular files transferred: 3\n" +
+		"Literal data: 1,234 bytes\n" +
+		"Matched data: 10 bytes\n" +
+		"Total bytes sent: 2,345\n" +
+		"Total bytes received: 99\n" +
+		"\n" +
+		"sent 2,345 bytes  received 99 bytes  4,888.00 bytes/sec\n" +
+		"total size is 1,257  speedup is 0.51"
+	var changes []Change
+	w := &statsWriter{report: func(change Change) {
+		changes = append(changes, change)
+	}}
+	// 按任意位置切分写入，模拟管道的读取
+	for i := 0; i < len(output); i += 7 {
+		w.Write([]byte(output[i:min(i+7, len(output))]))
+	}
+	w.Close()
+	want := []Change{
+		{Code: ".d..t......", Name: "./", Size: 4096},
+		{Code: ">f+++++++++", Name: "a.txt", Size: 1234, Sent: 1300},
+		{Code: "cL+++++++++", Name: "link", Size: 5},
+		{Code: "cd+++++++++", Name: "dir with space/", Size: 4096},
+		{Code: ">f.st......", Name: "dir with space/b c", Size: 20, Sent: 12},
+		{Code: "*deleting", Name: "gone"},
+		{Code: "hf+++++++++", Name: "hard", Size: 1234},
+		{Code: ">f+++++++++", Name: "tab\tname", Size: 3, Sent: 3},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes = %+v, want %+v", changes, want)
+	}
+	stats := Stats{Files: 3, Deleted: 1, Sent: 2345, Received: 99, Literal: 1234, Matched: 10}
+	if w.stats != stats {
+		t.Errorf("stats = %+v, want %+v", w.stats, stats)
+	}
+}
+
+func TestStatsWriterOldVersion(t *testing.T) {
+	w := &statsWriter{}
+	w.Write([]byte("Number of files transferred: 2\nTotal bytes sent: 100\n"))
+	w.Close()
+	if w.stats.Files != 2 || w.stats.Sent != 100 {
+		t.Errorf("stats = %+v", w.stats)
+	}
+}
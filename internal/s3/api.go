@@ -0,0 +1,298 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 单次复制对象的大小上限，更大的对象需要重新上传
+const maxCopySize = 5 << 30
+
+// S3兼容的对象存储接口，使用path-style访问bucket
+type api struct {
+	endpoint *url.URL
+	bucket   string
+	signer   signer
+	client   *http.Client
+}
+
+// 对象存储返回的错误
+type apiError struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (err *apiError) Error() string {
+	if err.Code == "" {
+		return fmt.Sprintf("s3 status %d", err.Status)
+	}
+	return fmt.Sprintf("s3 %s: %s (status %d)", err.Code, err.Message, err.Status)
+}
+
+// 认证失败、bucket不存在和网络错误时重试其他路径也不会成功
+func fatal(err error) bool {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case "InvalidAccessKeyId", "SignatureDoesNotMatch", "AccessDenied", "NoSuchBucket", "RequestTimeTooSkewed":
+			return true
+		}
+		return apiErr.Status == http.StatusUnauthorized || apiErr.Status == http.StatusForbidden
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func newAPI(endpoint *url.URL, bucket string, signer signer, timeout time.Duration, ioTimeout time.Duration) *api {
+	dialer := &net.Dialer{Timeout: timeout}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.ResponseHeaderTimeout = ioTimeout
+	return &api{endpoint: endpoint, bucket: bucket, signer: signer, client: &http.Client{Transport: transport}}
+}
+
+// 发送签名后的请求，返回2xx的响应体
+func (a *api) do(ctx context.Context, method string, key string, query url.Values, header http.Header, body []byte) ([]byte, http.Header, error) {
+	payloadHash := emptyHash
+	if len(body) > 0 {
+		payloadHash = hashHex(body)
+	}
+	return a.send(ctx, method, key, query, header, io.NewSectionReader(bytes.NewReader(body), 0, int64(len(body))), payloadHash)
+}
+
+// 上传文件的内容，签名需要的SHA256先读一遍计算，发送时再从头读取，不把整个分片读入内存
+func (a *api) stream(ctx context.Context, method string, key string, query url.Values, header http.Header, body *io.SectionReader) ([]byte, http.Header, error) {
+	hash := sha256.New()
+	_, err := io.Copy(hash, io.NewSectionReader(body, 0, body.Size()))
+	if err != nil {
+		return nil, nil, err
+	}
+	return a.send(ctx, method, key, query, header, body, hex.EncodeToString(hash.Sum(nil)))
+}
+
+func (a *api) send(ctx context.Context, method string, key string, query url.Values, header http.Header, body *io.SectionReader, payloadHash string) ([]byte, http.Header, error) {
+	path := strings.TrimSuffix(a.endpoint.Path, "/") + "/" + a.bucket
+	if key != "" {
+		path += "/" + key
+	}
+	u := *a.endpoint
+	u.Path = path
+	u.RawPath = strings.TrimSuffix(a.endpoint.EscapedPath(), "/") + "/" + escape(a.bucket, true)
+	if key != "" {
+		u.RawPath += "/" + escape(key, false)
+	}
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), io.NewSectionReader(body, 0, body.Size()))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.ContentLength = body.Size()
+	if body.Size() == 0 {
+		req.Body = http.NoBody
+	}
+	// 连接被复用前关闭时可以重新发送
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(io.NewSectionReader(body, 0, body.Size())), nil
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	a.signer.sign(req, payloadHash, time.Now())
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		apiErr := &apiError{Status: resp.StatusCode}
+		xml.Unmarshal(data, apiErr)
+		return nil, nil, apiErr
+	}
+	return data, resp.Header, nil
+}
+
+// 复制和完成分片上传时，错误可能在200的响应体中返回
+func bodyError(data []byte) error {
+	if !bytes.Contains(data, []byte("<Error>")) {
+		return nil
+	}
+	apiErr := &apiError{Status: http.StatusOK}
+	if xml.Unmarshal(data, apiErr) != nil || apiErr.Code == "" {
+		return nil
+	}
+	return apiErr
+}
+
+func (a *api) putObject(ctx context.Context, key string, body *io.SectionReader) (string, error) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	_, respHeader, err := a.stream(ctx, http.MethodPut, key, nil, header, body)
+	if err != nil {
+		return "", err
+	}
+	return respHeader.Get("ETag"), nil
+}
+
+func (a *api) createMultipartUpload(ctx context.Context, key string) (string, error) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	data, _, err := a.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadId string `xml:"UploadId"`
+	}
+	err = xml.Unmarshal(data, &result)
+	if err != nil {
+		return "", err
+	}
+	return result.UploadId, nil
+}
+
+func (a *api) uploadPart(ctx context.Context, key string, uploadId string, number int, body *io.SectionReader) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadId}}
+	_, header, err := a.stream(ctx, http.MethodPut, key, query, nil, body)
+	if err != nil {
+		return "", err
+	}
+	return header.Get("ETag"), nil
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (a *api) completeMultipartUpload(ctx context.Context, key string, uploadId string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	data, _, err := a.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadId}}, nil, body)
+	if err != nil {
+		return err
+	}
+	return bodyError(data)
+}
+
+func (a *api) abortMultipartUpload(ctx context.Context, key string, uploadId string) error {
+	_, _, err := a.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadId}}, nil, nil)
+	return err
+}
+
+func (a *api) copyObject(ctx context.Context, from string, to string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", "/"+escape(a.bucket, true)+"/"+escape(from, false))
+	data, _, err := a.do(ctx, http.MethodPut, to, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	return bodyError(data)
+}
+
+// 对象存储中的对象，ETag不含引号
+type object struct {
+	Key  string `xml:"Key"`
+	ETag string `xml:"ETag"`
+	Size int64  `xml:"Size"`
+}
+
+// 按名称顺序列出前缀下的所有对象
+func (a *api) listObjects(ctx context.Context, prefix string, fn func(object)) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		data, _, err := a.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Contents              []object `xml:"Contents"`
+			IsTruncated           bool     `xml:"IsTruncated"`
+			NextContinuationToken string   `xml:"NextContinuationToken"`
+		}
+		err = xml.Unmarshal(data, &result)
+		if err != nil {
+			return err
+		}
+		for _, obj := range result.Contents {
+			obj.ETag = strings.Trim(obj.ETag, `"`)
+			fn(obj)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// 一次最多删除1000个对象
+const maxDeleteKeys = 1000
+
+// 批量删除对象，开启版本控制的bucket中会产生删除标记，返回删除失败的对象
+func (a *api) deleteObjects(ctx context.Context, keys []string) (map[string]error, error) {
+	type deleteObject struct {
+		Key string `xml:"Key"`
+	}
+	request := struct {
+		XMLName xml.Name       `xml:"Delete"`
+		Quiet   bool           `xml:"Quiet"`
+		Objects []deleteObject `xml:"Object"`
+	}{Quiet: true}
+	for _, key := range keys {
+		request.Objects = append(request.Objects, deleteObject{Key: key})
+	}
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(body)
+	header := http.Header{}
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	data, _, err := a.do(ctx, http.MethodPost, "", url.Values{"delete": {""}}, header, body)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Errors []struct {
+			Key     string `xml:"Key"`
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		} `xml:"Error"`
+	}
+	err = xml.Unmarshal(data, &result)
+	if err != nil {
+		return nil, err
+	}
+	failed := map[string]error{}
+	for _, e := range result.Errors {
+		failed[e.Key] = &apiError{Status: http.StatusOK, Code: e.Code, Message: e.Message}
+	}
+	return failed, nil
+}
@@ -0,0 +1,510 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"gosync/conf"
+	"gosync/internal/dest"
+	"gosync/internal/metrics"
+	"gosync/internal/rsync"
+	"gosync/internal/tree"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 将同步目录镜像到S3兼容的对象存储，对象名为remote-path加上相对路径。
+// 对象存储没有目录，也不能保存符号链接和权限等属性，只同步文件的内容。
+type Client struct {
+	config   *conf.RsyncConfig
+	dest     *conf.DestinationConfig
+	workdir  string
+	api      *api
+	partSize int64
+	reporter func(dest.FileResult)
+}
+
+func New(c *conf.RsyncConfig, d *conf.DestinationConfig, workdir string) (*Client, error) {
+	endpoint, err := url.Parse(d.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var timeout, ioTimeout time.Duration
+	if d.Timeout != "" {
+		timeout, _ = time.ParseDuration(d.Timeout)
+	}
+	if d.IOTimeout != "" {
+		ioTimeout, _ = time.ParseDuration(d.IOTimeout)
+	}
+	client := &Client{
+		config:   c,
+		dest:     d,
+		workdir:  workdir,
+		api:      newAPI(endpoint, d.Bucket, signer{accessKey: d.AccessKey, secretKey: d.SecretKey, region: d.Region}, timeout, ioTimeout),
+		partSize: int64(d.PartSize) << 20,
+	}
+	return client, nil
+}
+
+func (client *Client) Close() {
+	client.api.client.CloseIdleConnections()
+}
+
+func (client *Client) Name() string {
+	if client.dest.Name == "" {
+		return client.config.Name
+	}
+	return client.config.Name + "/" + client.dest.Name
+}
+
+func (client *Client) Config() *conf.RsyncConfig {
+	return client.config
+}
+
+func (client *Client) WatchFolders() ([]string, error) {
+	return rsync.GetWatchFolders(client.config, client.workdir)
+}
+
+func (client *Client) SetReporter(reporter func(dest.FileResult)) {
+	client.reporter = reporter
+}
+
+func (client *Client) report(result dest.FileResult) {
+	outcome := "success"
+	if result.Err != nil {
+		outcome = "failure"
+	}
+	metrics.TransferFiles.Inc(client.Name(), outcome)
+	if client.reporter != nil {
+		client.reporter(result)
+	}
+}
+
+// 相对路径对应的对象名，目录对应对象名的前缀
+func (client *Client) key(path string) string {
+	return client.dest.RemotePath + path
+}
+
+func (client *Client) FullSync(ctx context.Context) error {
+	includes, err := client.WatchFolders()
+	if err == nil {
+		err = client.syncDir(ctx, "", includes, "")
+	}
+	if err != nil {
+		err = wrap("full", err)
+		logrus.WithError(err).Errorf("Full sync to %s failed.", client.Name())
+		return err
+	}
+	logrus.Infof("Full sync to %s successfully.", client.Name())
+	return nil
+}
+
+// 认证失败、bucket不存在和网络错误时重试其他路径也不会成功
+func wrap(op string, err error) error {
+	return &dest.Error{Op: op, Fatal: fatal(err), Err: err}
+}
+
+// 逐个上传文件或同步目录，返回同步失败的路径
+func (client *Client) SyncFiles(ctx context.Context, paths []string) dest.Result {
+	result := dest.Result{}
+	for i, path := range paths {
+		info, err := client.stat(path)
+		if err != nil {
+			logrus.Warnf("Ignore sync because path is not exists: %s", path)
+			continue
+		}
+		if info.IsDir() {
+			err = client.syncDir(ctx, path, nil, "")
+		} else if info.Mode().IsRegular() {
+			err = client.upload(ctx, path).Err
+		} else {
+			logrus.Debugf("Ignore sync because %s is not a regular file.", path)
+			continue
+		}
+		if err != nil {
+			err = wrap("sync", err)
+			logrus.WithError(err).Errorf("Sync %s to %s failed.", path, client.Name())
+			result.Fail(path, err)
+			// 不可恢复的错误或被取消时其余路径也作为失败返回
+			if dest.IsFatal(err) || ctx.Err() != nil {
+				result.Failed = append(result.Failed, paths[i+1:]...)
+				break
+			}
+		}
+	}
+	if result.OK() {
+		logrus.Infof("Sync %d paths to %s successfully.", len(paths), client.Name())
+	}
+	return result
+}
+
+// 删除对象，目录删除前缀下的所有对象，本地又已存在的路径由之后的同步任务处理
+func (client *Client) DeleteFiles(ctx context.Context, paths []string) dest.Result {
+	if !client.config.AllowDelete {
+		return dest.Result{}
+	}
+	keys := []string{}
+	owners := map[string]string{}
+	result := dest.Result{}
+	for i, path := range paths {
+		if _, err := os.Lstat(client.config.RootPath + path); err == nil {
+			logrus.Debugf("Ignore delete because path exists again: %s", path)
+			continue
+		}
+		if !strings.HasSuffix(path, "/") {
+			keys = append(keys, client.key(path))
+			owners[client.key(path)] = path
+			continue
+		}
+		err := client.api.listObjects(ctx, client.key(path), func(obj object) {
+			if name := strings.TrimPrefix(obj.Key, client.dest.RemotePath); !client.protected(name) {
+				keys = append(keys, obj.Key)
+				owners[obj.Key] = path
+			}
+		})
+		if err != nil {
+			err = wrap("delete", err)
+			logrus.WithError(err).Errorf("List %s of %s failed.", path, client.Name())
+			result.Fail(path, err)
+			// 不可恢复的错误或被取消时其余路径也作为失败返回
+			if dest.IsFatal(err) || ctx.Err() != nil {
+				result.Failed = append(result.Failed, paths[i+1:]...)
+				return result
+			}
+		}
+	}
+	failures, err := client.deleteKeys(ctx, keys)
+	if err != nil {
+		err = wrap("delete", err)
+		logrus.WithError(err).Errorf("Delete from %s failed.", client.Name())
+	} else if len(failures) > 0 {
+		err = wrap("delete", fmt.Errorf("delete %d objects failed", len(failures)))
+	}
+	for _, key := range failures {
+		if !slices.Contains(result.Failed, owners[key]) {
+			result.Fail(owners[key], err)
+		}
+	}
+	if result.OK() {
+		logrus.Infof("Delete %d paths from %s successfully.", len(paths), client.Name())
+	}
+	return result
+}
+
+// 对象存储不保存权限、属主和修改时间，内容没有变化时不需要同步
+func (client *Client) SyncAttrs(ctx context.Context, paths []string) dest.Result {
+	logrus.Debugf("Ignore attributes of %d paths, %s does not keep them.", len(paths), client.Name())
+	return dest.Result{}
+}
+
+// 对象存储没有重命名，内容相同的对象在服务端复制，不需要重新上传，之后再删除原路径
+func (client *Client) Rename(ctx context.Context, from string, to string) error {
+	info, err := client.stat(to)
+	if err == nil {
+		if info.IsDir() {
+			err = client.syncDir(ctx, to, nil, from)
+		} else if info.Mode().IsRegular() {
+			err = client.renameFile(ctx, from, to, info)
+		}
+		if err != nil {
+			err = wrap("rename", err)
+			logrus.WithError(err).Errorf("Rename %s -> %s on %s failed.", from, to, client.Name())
+			return err
+		}
+	} else {
+		logrus.Warnf("Ignore sync because path is not exists: %s", to)
+	}
+	return client.DeleteFiles(ctx, []string{from}).Err
+}
+
+func (client *Client) renameFile(ctx context.Context, from string, to string, info fs.FileInfo) error {
+	var basis *object
+	err := client.api.listObjects(ctx, client.key(from), func(obj object) {
+		if obj.Key == client.key(from) {
+			basis = &obj
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if basis != nil && client.same(*basis, to, info) {
+		return client.copy(ctx, from, to, info)
+	}
+	return client.upload(ctx, to).Err
+}
+
+// 将本地目录同步到对象存储：上传不存在或大小、ETag不一致的文件，允许删除时删除本地已不存在的对象。
+// from不为空时，from下内容相同的对象通过服务端复制得到。读取本地目录出错时不删除远端的对象。
+func (client *Client) syncDir(ctx context.Context, dir string, includes []string, from string) error {
+	remote := map[string]object{}
+	err := client.api.listObjects(ctx, client.key(dir), func(obj object) {
+		remote[strings.TrimPrefix(obj.Key, client.dest.RemotePath)] = obj
+	})
+	if err != nil {
+		return err
+	}
+	basis := map[string]object{}
+	if from != "" {
+		err = client.api.listObjects(ctx, client.key(from), func(obj object) {
+			basis[strings.TrimPrefix(obj.Key, client.key(from))] = obj
+		})
+		if err != nil {
+			return err
+		}
+	}
+	uploaded, copied := 0, 0
+	var failure error
+	err = client.walk(dir, includes, func(path string, info fs.FileInfo) error {
+		obj, exists := remote[path]
+		delete(remote, path)
+		if exists && client.same(obj, path, info) {
+			return nil
+		}
+		var err error
+		if obj, ok := basis[strings.TrimPrefix(path, dir)]; ok && client.same(obj, path, info) {
+			err = client.copy(ctx, strings.TrimPrefix(obj.Key, client.dest.RemotePath), path, info)
+			copied++
+		} else {
+			err = client.upload(ctx, path).Err
+			uploaded++
+		}
+		if err != nil {
+			if fatal(err) || ctx.Err() != nil {
+				return err
+			}
+			logrus.WithError(err).Errorf("Upload %s to %s failed.", path, client.Name())
+			if failure == nil {
+				failure = err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if failure != nil {
+		return failure
+	}
+	deleted := 0
+	if client.config.AllowDelete {
+		keys := []string{}
+		for path, obj := range remote {
+			if !strings.HasSuffix(path, "/") && !client.protected(path) && tree.ShouldWatch(includes, path) {
+				keys = append(keys, obj.Key)
+			}
+		}
+		sort.Strings(keys)
+		failures, err := client.deleteKeys(ctx, keys)
+		if err != nil {
+			return err
+		}
+		if len(failures) > 0 {
+			return fmt.Errorf("delete %d objects failed", len(failures))
+		}
+		deleted = len(keys)
+	}
+	logrus.Debugf("Sync %s to %s: %d uploaded, %d copied, %d deleted.", "/"+dir, client.Name(), uploaded, copied, deleted)
+	return nil
+}
+
+// 分批删除对象，返回删除失败的对象名
+func (client *Client) deleteKeys(ctx context.Context, keys []string) ([]string, error) {
+	failed := []string{}
+	var first error
+	for start := 0; start < len(keys); start += maxDeleteKeys {
+		batch := keys[start:min(start+maxDeleteKeys, len(keys))]
+		failures, err := client.api.deleteObjects(ctx, batch)
+		if err != nil {
+			failed = append(failed, batch...)
+			if first == nil {
+				first = err
+			}
+			if fatal(err) || ctx.Err() != nil {
+				return append(failed, keys[start+len(batch):]...), first
+			}
+			continue
+		}
+		for _, key := range batch {
+			if err, ok := failures[key]; ok {
+				logrus.WithError(err).Errorf("Delete %s from %s failed.", key, client.Name())
+				failed = append(failed, key)
+			} else {
+				logrus.Debugf("Deleted %s from %s.", key, client.Name())
+			}
+		}
+	}
+	return failed, first
+}
+
+// 服务端复制对象，超过单次复制上限时重新上传
+func (client *Client) copy(ctx context.Context, from string, to string, info fs.FileInfo) error {
+	if info.Size() > maxCopySize {
+		return client.upload(ctx, to).Err
+	}
+	err := client.api.copyObject(ctx, client.key(from), client.key(to))
+	client.report(dest.FileResult{Path: to, Size: info.Size(), Err: err})
+	return err
+}
+
+// 上传文件，超过分片大小时使用分片上传
+func (client *Client) upload(ctx context.Context, path string) dest.FileResult {
+	result := dest.FileResult{Path: path}
+	file, err := os.Open(client.config.RootPath + path)
+	if err == nil {
+		defer file.Close()
+		var info fs.FileInfo
+		info, err = file.Stat()
+		if err == nil {
+			result.Size = info.Size()
+			if result.Size <= client.partSize {
+				_, err = client.api.putObject(ctx, client.key(path), io.NewSectionReader(file, 0, result.Size))
+				result.Sent = result.Size
+			} else {
+				result.Sent, err = client.multipartUpload(ctx, path, file, result.Size)
+			}
+		}
+	}
+	result.Err = err
+	if err != nil {
+		result.Sent = 0
+		logrus.WithError(err).Debugf("Upload %s to %s failed.", path, client.Name())
+	} else {
+		logrus.Debugf("Uploaded %s to %s (%d bytes).", path, client.Name(), result.Sent)
+	}
+	client.report(result)
+	return result
+}
+
+// 分片上传，每个分片直接从文件中读取，失败时放弃上传以释放已上传的分片
+func (client *Client) multipartUpload(ctx context.Context, path string, file io.ReaderAt, size int64) (int64, error) {
+	key := client.key(path)
+	uploadId, err := client.api.createMultipartUpload(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	parts := []completedPart{}
+	for offset := int64(0); offset < size; offset += client.partSize {
+		var etag string
+		etag, err = client.api.uploadPart(ctx, key, uploadId, len(parts)+1, io.NewSectionReader(file, offset, min(client.partSize, size-offset)))
+		if err != nil {
+			break
+		}
+		parts = append(parts, completedPart{PartNumber: len(parts) + 1, ETag: etag})
+	}
+	if err == nil {
+		err = client.api.completeMultipartUpload(ctx, key, uploadId, parts)
+	}
+	if err != nil {
+		abortErr := client.api.abortMultipartUpload(context.WithoutCancel(ctx), key, uploadId)
+		if abortErr != nil {
+			logrus.WithError(abortErr).Warnf("Abort multipart upload of %s failed.", key)
+		}
+		return 0, err
+	}
+	return size, nil
+}
+
+// 对象与本地文件的大小和ETag都相同时认为内容相同，分片上传的对象按相同的分片大小计算ETag
+func (client *Client) same(obj object, path string, info fs.FileInfo) bool {
+	if obj.Size != info.Size() {
+		return false
+	}
+	etag, err := client.etag(path)
+	if err != nil {
+		logrus.WithError(err).Debugf("Compute ETag of %s failed.", path)
+		return false
+	}
+	return strings.EqualFold(etag, obj.ETag)
+}
+
+// 不超过分片大小的文件ETag为内容的MD5，分片上传的ETag为各分片MD5拼接后的MD5加上分片数
+func (client *Client) etag(path string) (string, error) {
+	file, err := os.Open(client.config.RootPath + path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	sums := []byte{}
+	parts := 0
+	for {
+		hash := md5.New()
+		n, err := io.CopyN(hash, file, client.partSize)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if n > 0 || parts == 0 {
+			sums = hash.Sum(sums)
+			parts++
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if parts == 1 {
+		return hex.EncodeToString(sums), nil
+	}
+	sum := md5.Sum(sums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), parts), nil
+}
+
+// 按符号链接策略获取本地路径的状态，只有follow时才上传符号链接指向的文件
+func (client *Client) stat(path string) (fs.FileInfo, error) {
+	if client.config.Symlinks == "follow" {
+		return os.Stat(client.config.RootPath + path)
+	}
+	info, err := os.Lstat(client.config.RootPath + path)
+	if err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		return nil, fmt.Errorf("%s is a symlink", path)
+	}
+	return info, err
+}
+
+// 按名称顺序遍历dir(相对路径，空表示根目录)下需要上传的文件，跳过排除的路径和不在监听范围的路径。
+// 对象存储不能保存符号链接，只有follow时才上传链接指向的文件。读取目录失败时返回错误，不能据此删除远端的对象。
+func (client *Client) walk(dir string, includes []string, fn func(path string, info fs.FileInfo) error) error {
+	symlinks := client.config.Symlinks
+	if symlinks != "follow" {
+		symlinks = "skip"
+	}
+	return tree.Walk(client.config.RootPath, dir, symlinks, func(path string, info fs.FileInfo, err error) (bool, error) {
+		if err != nil {
+			// 遍历过程中被删除的路径和失效的链接忽略即可
+			if info == nil && path != dir {
+				logrus.Debugf("Ignore %s: %s", path, err.Error())
+				return false, nil
+			}
+			return false, err
+		}
+		if path == dir {
+			return true, nil
+		}
+		if tree.Excluded(client.config.Excludes, path) || !tree.ShouldWatch(includes, path) {
+			return false, nil
+		}
+		if info.Mode().IsRegular() {
+			return false, fn(path, info)
+		}
+		return info.IsDir(), nil
+	})
+}
+
+// 路径本身或所在的目录被排除时，对象不会被删除
+func (client *Client) protected(path string) bool {
+	for dir := path; dir != ""; {
+		if tree.Excluded(client.config.Excludes, dir) {
+			return true
+		}
+		i := strings.LastIndex(strings.TrimSuffix(dir, "/"), "/")
+		dir = dir[:i+1]
+	}
+	return false
+}
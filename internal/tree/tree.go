@@ -0,0 +1,116 @@
+package tree
+
+import (
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// 目录的设备号和inode，用于检测符号链接形成的环
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// 按名称顺序遍历root下的dir(相对路径，空表示根目录)及其子路径，目录以/结尾。
+// 符号链接按策略处理：copy作为链接本身，follow按链接指向的文件或目录处理，skip忽略。
+// follow时链接指向祖先目录会形成环，此时不再进入。
+// fn返回false时不进入该目录，无法读取的路径也会调用fn并传入错误，fn返回错误时终止遍历。
+func Walk(root string, dir string, symlinks string, fn func(path string, info fs.FileInfo, err error) (bool, error)) error {
+	info, err := os.Stat(root + dir)
+	if err != nil {
+		_, err = fn(dir, nil, err)
+		return err
+	}
+	return walkPath(root, dir, info, symlinks, map[fileID]bool{}, fn)
+}
+
+func walkPath(root string, path string, info fs.FileInfo, symlinks string, ancestors map[fileID]bool, fn func(string, fs.FileInfo, error) (bool, error)) error {
+	var id fileID
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.IsDir() {
+		id = fileID{dev: uint64(stat.Dev), ino: stat.Ino}
+		if ancestors[id] {
+			logrus.Warnf("Skip symlink loop: %s", path)
+			return nil
+		}
+	}
+	descend, err := fn(path, info, nil)
+	if err != nil || !descend || !info.IsDir() {
+		return err
+	}
+	ancestors[id] = true
+	defer delete(ancestors, id)
+	entries, err := os.ReadDir(root + path)
+	if err != nil {
+		_, err = fn(path, info, err)
+		return err
+	}
+	for _, entry := range entries {
+		child := path + entry.Name()
+		var info fs.FileInfo
+		var err error
+		if entry.Type()&fs.ModeSymlink != 0 && symlinks == "skip" {
+			continue
+		} else if entry.Type()&fs.ModeSymlink != 0 && symlinks == "follow" {
+			info, err = os.Stat(root + child)
+		} else {
+			info, err = entry.Info()
+		}
+		if err != nil {
+			if _, err := fn(child, nil, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if info.IsDir() {
+			child += "/"
+		}
+		if err := walkPath(root, child, info, symlinks, ancestors, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 路径是否被排除，规则以/开头时从根目录匹配，不以/结尾的规则同时匹配文件和目录
+func Excluded(excludes []string, path string) bool {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	for _, exclude := range excludes {
+		if !strings.HasPrefix(exclude, "/") {
+			exclude = "/" + exclude
+		}
+		name := path
+		if !strings.HasSuffix(exclude, "/") {
+			name = strings.TrimSuffix(name, "/")
+		}
+		match, err := doublestar.Match(exclude, name)
+		if match && err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// 路径是否在监听范围内，范围内目录的上级目录也需要监听。includes为nil表示监听整个目录
+func ShouldWatch(includes []string, path string) bool {
+	if includes == nil || path == "." || path == "./" {
+		return true
+	}
+	for _, include := range includes {
+		match, err := doublestar.Match(include+"**", path)
+		if match && err == nil {
+			return true
+		}
+		match, err = doublestar.Match(path+"**", include)
+		if match && err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package tree
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExcluded(t *testing.T) {
+	excludes := []string{"*.tmp", "/cache/", "logs/**/*.gz", ".git"}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"a.tmp", true},
+		{"dir/a.tmp", false},
+		{"cache/", true},
+		{"cache", false},
+		{"sub/cache/", false},
+		{"logs/2024/01/a.gz", true},
+		{"logs/a.log", false},
+		{".git/", true},
+		{".git", true},
+		{"data/", false},
+	}
+	for _, test := range tests {
+		if got := Excluded(excludes, test.path); got != test.want {
+			t.Errorf("Excluded(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestShouldWatch(t *testing.T) {
+	includes := []string{"data/logs/", "static/*/img/"}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"./", true},
+		{"data/", true},
+		{"data/logs/", true},
+		{"data/logs/a/b.log", true},
+		{"data/tmp/", false},
+		{"static/", true},
+		{"static/v1/img/a.png", true},
+		{"static/v1/css/", false},
+		{"other.txt", false},
+	}
+	for _, test := range tests {
+		if got := ShouldWatch(includes, test.path); got != test.want {
+			t.Errorf("ShouldWatch(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+	if !ShouldWatch(nil, "anything") {
+		t.Error("nil includes should watch everything")
+	}
+}
+
+func TestWalkSymlinks(t *testing.T) {
+	root := t.TempDir() + "/"
+	for _, dir := range []string{"a/b", "c"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(root, "a/b/f"), nil, 0644)
+	os.WriteFile(filepath.Join(root, "c/g"), nil, 0644)
+	// 指向祖先目录的链接形成环，指向其他目录的链接在follow时展开
+	os.Symlink("../..", filepath.Join(root, "a/b/loop"))
+	os.Symlink("../c", filepath.Join(root, "a/link"))
+	os.Symlink("missing", filepath.Join(root, "dangling"))
+
+	walk := func(symlinks string) []string {
+		paths := []string{}
+		err := Walk(root, "", symlinks, func(path string, info fs.FileInfo, err error) (bool, error) {
+			if err != nil {
+				paths = append(paths, "!"+path)
+				return false, nil
+			}
+			paths = append(paths, path)
+			return true, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return paths
+	}
+	tests := map[string][]string{
+		"copy":   {"", "a/", "a/b/", "a/b/f", "a/b/loop", "a/link", "c/", "c/g", "dangling"},
+		"skip":   {"", "a/", "a/b/", "a/b/f", "c/", "c/g"},
+		"follow": {"", "a/", "a/b/", "a/b/f", "a/link/", "a/link/g", "c/", "c/g", "!dangling"},
+	}
+	for symlinks, want := range tests {
+		if got := walk(symlinks); !reflect.DeepEqual(got, want) {
+			t.Errorf("Walk(%s) = %v, want %v", symlinks, got, want)
+		}
+	}
+}
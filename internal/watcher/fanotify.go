@@ -0,0 +1,259 @@
+package watcher
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"gosync/conf"
+	"gosync/internal/metrics"
+	"gosync/internal/rsync"
+	"gosync/internal/tree"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const fanotifyMask = unix.FAN_CREATE | unix.FAN_DELETE | unix.FAN_CLOSE_WRITE | unix.FAN_ATTRIB | unix.FAN_ONDIR
+
+const sizeofFanotifyEventMetadata = int(unsafe.Sizeof(unix.FanotifyEventMetadata{}))
+
+// 使用fanotify在文件系统或挂载点上监听，事件中携带父目录的file handle和文件名(FAN_REPORT_DFID_NAME)，
+// 无需为每个目录添加监听，适合目录数量非常多的场景。需要CAP_SYS_ADMIN权限和5.9以上的内核。
+func watchFanotify(ctx context.Context, config *conf.RsyncConfig, workdir string, watchDir string, queues []*Queue) error {
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_REPORT_DFID_NAME, unix.O_RDONLY|unix.O_CLOEXEC)
+	if err != nil {
+		logrus.WithError(err).Error("Cannot initialize fanotify.")
+		return err
+	}
+	defer unix.Close(fd)
+
+	// 用于通过file handle打开目录，需要与监听目录在同一个文件系统
+	mountFd, err := unix.Open(watchDir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		logrus.WithError(err).Errorf("Cannot open %s.", watchDir)
+		return err
+	}
+	defer unix.Close(mountFd)
+
+	flags := uint(unix.FAN_MARK_ADD | unix.FAN_MARK_FILESYSTEM)
+	if config.FanotifyMark == "mount" {
+		flags = unix.FAN_MARK_ADD | unix.FAN_MARK_MOUNT
+	}
+	// FAN_RENAME(5.17+)在一个事件中同时携带原路径和新路径，不支持时退回到FAN_MOVED_FROM/FAN_MOVED_TO
+	err = unix.FanotifyMark(fd, flags, fanotifyMask|unix.FAN_RENAME, unix.AT_FDCWD, watchDir)
+	if err == unix.EINVAL {
+		err = unix.FanotifyMark(fd, flags, fanotifyMask|unix.FAN_MOVED_FROM|unix.FAN_MOVED_TO, unix.AT_FDCWD, watchDir)
+	}
+	if err != nil {
+		logrus.WithError(err).Errorf("Watch %s failed.", watchDir)
+		return err
+	}
+
+	// 通过/proc/self/fd解析出的路径不含符号链接，root-path中有符号链接时需要与解析后的路径比较
+	realDir, err := filepath.EvalSymlinks(watchDir)
+	if err != nil {
+		logrus.WithError(err).Errorf("Cannot resolve %s.", watchDir)
+		return err
+	}
+	realDir = strings.TrimSuffix(realDir, "/") + "/"
+
+	includes, err := rsync.GetWatchFolders(config, workdir)
+	if err != nil {
+		logrus.WithError(err).Error("Eval watch scope error")
+		return err
+	}
+	logrus.Infof("Watch %s started. (fanotify %s mark)", watchDir, config.FanotifyMark)
+	startQueues(ctx, config, queues)
+
+	stopFd, closeStopFd, err := stopNotifier(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeStopFd()
+
+	relPath := func(path string, isDir bool) string {
+		return fanotifyRelPath(realDir, includes, path, isDir)
+	}
+
+	buf := make([]byte, 64*1024)
+	retry := readRetry{}
+	for {
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}, {Fd: int32(stopFd), Events: unix.POLLIN}}
+		_, err := unix.Poll(fds, -1)
+		if fds[1].Revents != 0 {
+			logrus.Infof("Watch %s stopped.", watchDir)
+			return nil
+		}
+		if err != nil || fds[0].Revents == 0 {
+			continue
+		}
+		n, err := unix.Read(fd, buf)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			if err := retry.failed(ctx, config, watchDir, queues, err); err != nil {
+				return err
+			}
+			continue
+		}
+		retry.succeeded()
+
+		config = current(config)
+		for offset := 0; offset+sizeofFanotifyEventMetadata <= n; {
+			meta := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[offset]))
+			if int(meta.Event_len) < sizeofFanotifyEventMetadata || offset+int(meta.Event_len) > n {
+				break
+			}
+			if meta.Vers != unix.FANOTIFY_METADATA_VERSION {
+				return fmt.Errorf("fanotify metadata version mismatch: %d", meta.Vers)
+			}
+			event := buf[offset : offset+int(meta.Event_len)]
+			offset += int(meta.Event_len)
+			if meta.Fd >= 0 {
+				unix.Close(int(meta.Fd))
+			}
+
+			if meta.Mask&unix.FAN_Q_OVERFLOW != 0 {
+				overflows.Add(1)
+				metrics.WatchOverflows.Inc(config.Name)
+				logrus.Errorf("Fanotify event queue of %s overflowed, a full sync will be performed to recover.", watchDir)
+				scheduleFullSync(queues)
+				continue
+			}
+
+			// 解析事件附带的父目录和文件名
+			var path, from, to string
+			for info := event[meta.Metadata_len:]; len(info) >= 4; {
+				infoType := info[0]
+				infoLen := int(binary.NativeEndian.Uint16(info[2:4]))
+				if infoLen < 4 || infoLen > len(info) {
+					break
+				}
+				record := info[:infoLen]
+				info = info[infoLen:]
+				switch infoType {
+				case unix.FAN_EVENT_INFO_TYPE_DFID_NAME:
+					path = resolveHandle(mountFd, record)
+				case unix.FAN_EVENT_INFO_TYPE_OLD_DFID_NAME:
+					from = resolveHandle(mountFd, record)
+				case unix.FAN_EVENT_INFO_TYPE_NEW_DFID_NAME:
+					to = resolveHandle(mountFd, record)
+				}
+			}
+
+			isDir := meta.Mask&unix.FAN_ONDIR != 0
+			if meta.Mask&unix.FAN_RENAME != 0 {
+				from, to = relPath(from, isDir), relPath(to, isDir)
+				offerMove(config, includes, queues, from, to)
+				continue
+			}
+			eventPath := relPath(path, isDir)
+			if eventPath == "" {
+				continue
+			}
+			if scope := offerFanotify(config, workdir, includes, queues, meta.Mask, eventPath, isDir); scope != nil {
+				includes = scope
+			}
+		}
+		syncJournals(queues)
+	}
+}
+
+// 处理一个fanotify事件，内核合并的事件可能同时带有多个类型，无法确定先后顺序。
+// 删除和移出只在路径已经不存在时处理，删除后又重新创建的路径按新建或写入同步。
+// includes为当前的监听范围，新建的目录在监听范围内时返回新的监听范围。
+func offerFanotify(config *conf.RsyncConfig, workdir string, includes []string, queues []*Queue, mask uint64, eventPath string, isDir bool) []string {
+	info, err := os.Lstat(config.RootPath + eventPath)
+	gone := os.IsNotExist(err)
+	var scope []string
+	if mask&unix.FAN_CREATE != 0 && !isDir {
+		offerSymlink(config, workdir, nil, queues, eventPath)
+	}
+	if mask&unix.FAN_CREATE != 0 && isDir {
+		// 新建目录时重新计算监听范围
+		if latest, ok := inScope(config, workdir, eventPath); ok {
+			scope = latest
+			offer(queues, CREATE, eventPath)
+		}
+	}
+	if mask&unix.FAN_CLOSE_WRITE != 0 && !tree.Excluded(config.Excludes, eventPath) {
+		offer(queues, WRITE, eventPath)
+	}
+	// 没有FAN_RENAME时无法配对，移动按新建和删除处理
+	if mask&unix.FAN_MOVED_TO != 0 {
+		offerMove(config, includes, queues, "", eventPath)
+	}
+	if mask&unix.FAN_MOVED_FROM != 0 && gone {
+		offerMove(config, includes, queues, eventPath, "")
+	}
+	if mask&unix.FAN_ATTRIB != 0 && !tree.Excluded(config.Excludes, eventPath) {
+		offer(queues, ATTRIB, eventPath)
+	}
+	if mask&unix.FAN_DELETE != 0 && gone && config.AllowDelete && !tree.Excluded(config.Excludes, eventPath) {
+		offer(queues, DELETE, eventPath)
+	}
+	// 被删除或移出后又出现的路径，内容可能已经变化
+	if mask&(unix.FAN_DELETE|unix.FAN_MOVED_FROM) != 0 && err == nil && !tree.Excluded(config.Excludes, eventPath) {
+		if isDir {
+			offer(queues, CREATE, eventPath)
+		} else if info.Mode()&fs.ModeSymlink != 0 {
+			offerSymlink(config, workdir, nil, queues, eventPath)
+		} else {
+			offer(queues, WRITE, eventPath)
+		}
+	}
+	return scope
+}
+
+// 将fanotify_event_info_fid中的目录file handle和文件名解析为绝对路径，目录已经不存在时返回空
+func resolveHandle(mountFd int, record []byte) string {
+	// info header(4) + fsid(8) + handle_bytes(4) + handle_type(4) + f_handle + name
+	if len(record) < 20 {
+		return ""
+	}
+	size := int(binary.NativeEndian.Uint32(record[12:16]))
+	handleType := int32(binary.NativeEndian.Uint32(record[16:20]))
+	if len(record) < 20+size {
+		return ""
+	}
+	handle := unix.NewFileHandle(handleType, record[20:20+size])
+	name := string(record[20+size:])
+	if i := strings.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	dirFd, err := unix.OpenByHandleAt(mountFd, handle, unix.O_PATH)
+	if err != nil {
+		logrus.Debugf("Cannot open file handle: %s", err.Error())
+		return ""
+	}
+	defer unix.Close(dirFd)
+	dir, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", dirFd))
+	if err != nil {
+		return ""
+	}
+	if name == "" || name == "." {
+		return dir
+	}
+	return strings.TrimSuffix(dir, "/") + "/" + name
+}
+
+// 文件系统范围内的事件都会上报，只处理监听目录下并且在监听范围内的路径，不在范围内时返回空
+func fanotifyRelPath(realDir string, includes []string, path string, isDir bool) string {
+	if path == "" || !strings.HasPrefix(path+"/", realDir) || path+"/" == realDir {
+		return ""
+	}
+	path = strings.TrimPrefix(path, realDir)
+	if isDir {
+		path += "/"
+	}
+	if !tree.ShouldWatch(includes, path) {
+		return ""
+	}
+	return path
+}
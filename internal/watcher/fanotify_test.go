@@ -0,0 +1,90 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// root-path经过符号链接时，事件中的路径是解析后的路径
+func TestFanotifyRelPathThroughSymlink(t *testing.T) {
+	tmp := t.TempDir()
+	real := filepath.Join(tmp, "real")
+	if err := os.Mkdir(real, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(tmp, "link")
+	if err := os.Symlink(real, link); err != nil {
+		t.Fatal(err)
+	}
+	realDir, err := filepath.EvalSymlinks(link + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	realDir = strings.TrimSuffix(realDir, "/") + "/"
+	includes := []string{"logs/"}
+	tests := []struct {
+		path  string
+		isDir bool
+		want  string
+	}{
+		{filepath.Join(real, "logs/a.log"), false, "logs/a.log"},
+		{filepath.Join(real, "logs/2024"), true, "logs/2024/"},
+		{filepath.Join(real, "logs"), true, "logs/"},
+		{filepath.Join(real, "data/b"), false, ""},
+		{real, true, ""},
+		{real + "2/logs/a.log", false, ""},
+		{"", false, ""},
+	}
+	for _, test := range tests {
+		if got := fanotifyRelPath(realDir, includes, test.path, test.isDir); got != test.want {
+			t.Errorf("fanotifyRelPath(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+// 合并的事件中删除总是最后处理，路径仍然存在时按当前内容同步
+func TestOfferFanotifyMergedMask(t *testing.T) {
+	tests := []struct {
+		name     string
+		mask     uint64
+		path     string
+		isDir    bool
+		exists   bool
+		noDelete bool
+		want     []string
+	}{
+		{"deleted and recreated", unix.FAN_DELETE | unix.FAN_CREATE | unix.FAN_CLOSE_WRITE, "a.txt", false, true, false, []string{"WRITE a.txt"}},
+		{"deleted and recreated without write", unix.FAN_CREATE | unix.FAN_DELETE, "a.txt", false, true, false, []string{"WRITE a.txt"}},
+		{"created and deleted", unix.FAN_CREATE | unix.FAN_CLOSE_WRITE | unix.FAN_DELETE, "a.txt", false, false, false, []string{"DELETE a.txt"}},
+		{"folder recreated", unix.FAN_DELETE | unix.FAN_CREATE | unix.FAN_ONDIR, "dir/", true, true, false, []string{"CREATE dir/"}},
+		{"moved out and in", unix.FAN_MOVED_FROM | unix.FAN_MOVED_TO, "a.txt", false, true, false, []string{"WRITE a.txt"}},
+		{"moved out", unix.FAN_MOVED_FROM, "a.txt", false, false, false, []string{"DELETE a.txt"}},
+		{"deleted without allow-delete", unix.FAN_DELETE, "a.txt", false, false, true, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue, fake := newTestQueue(t, 1)
+			config := *fake.Config()
+			config.AllowDelete = !test.noDelete
+			if test.exists {
+				var err error
+				if test.isDir {
+					err = os.Mkdir(config.RootPath+test.path, 0755)
+				} else {
+					err = os.WriteFile(config.RootPath+test.path, []byte("new"), 0644)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			offerFanotify(&config, "", nil, []*Queue{queue}, test.mask, test.path, test.isDir)
+			if got := actionStrs(queue.actions); strings.Join(got, "; ") != strings.Join(test.want, "; ") {
+				t.Errorf("actions = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
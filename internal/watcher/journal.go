@@ -0,0 +1,288 @@
+package watcher
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	journalOffer        = "offer"
+	journalDone         = "done"
+	journalFullSync     = "full-sync"
+	journalFullSyncDone = "full-sync-done"
+)
+
+// 日志中累计的记录数超过该值且超过未完成任务数的两倍时，用未完成的任务重写日志文件，
+// 持续有新任务入队时也能控制日志文件的大小
+const journalCompactThreshold = 10000
+
+type journalRecord struct {
+	Op        string `json:"op"`
+	ID        uint64 `json:"id,omitempty"`
+	Method    int    `json:"method,omitempty"`
+	Path      string `json:"path,omitempty"`
+	From      string `json:"from,omitempty"`
+	IsDir     bool   `json:"dir,omitempty"`
+	Timestamp int64  `json:"ts,omitempty"`
+	Since     int64  `json:"since,omitempty"`
+}
+
+// 只追加写的变更日志，记录入队的任务及其完成情况，重启后可以恢复未完成的任务
+type Journal struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	writer   *bufio.Writer
+	seq      uint64
+	pending  map[uint64]Action
+	fullSync bool
+	records  int
+	// 有记录写入后还没有同步到磁盘
+	dirty bool
+}
+
+// 打开变更日志并恢复上次未完成的任务，exists表示日志文件在打开前已经存在
+func OpenJournal(dir string, name string) (journal *Journal, exists bool, err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, false, err
+	}
+	journal = &Journal{
+		path:    filepath.Join(dir, strings.ReplaceAll(name, "/", "-")+".journal"),
+		pending: map[uint64]Action{},
+	}
+	_, err = os.Stat(journal.path)
+	exists = err == nil
+	if exists {
+		err = journal.load()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	err = journal.rewrite()
+	if err != nil {
+		return nil, false, err
+	}
+	return journal, exists, nil
+}
+
+func (journal *Journal) load() error {
+	file, err := os.Open(journal.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record journalRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			// 进程崩溃时最后一行可能没有写完整
+			logrus.Warnf("Skip broken journal record in %s: %s", journal.path, scanner.Text())
+			continue
+		}
+		if record.ID > journal.seq {
+			journal.seq = record.ID
+		}
+		switch record.Op {
+		case journalOffer:
+			action := Action{Method: record.Method, Path: record.Path, From: record.From, IsDir: record.IsDir, Timestamp: record.Timestamp, Since: record.Since, id: record.ID}
+			// 旧版本的日志没有since
+			if action.Since == 0 {
+				action.Since = action.Timestamp
+			}
+			journal.pending[record.ID] = action
+		case journalDone:
+			delete(journal.pending, record.ID)
+		case journalFullSync:
+			journal.fullSync = true
+		case journalFullSyncDone:
+			journal.fullSync = false
+		}
+	}
+	return scanner.Err()
+}
+
+// 用未完成的任务重写日志文件，新文件替换成功前继续使用原来的文件
+func (journal *Journal) rewrite() error {
+	tmp := journal.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	records := 0
+	if journal.fullSync {
+		writeRecord(writer, journalRecord{Op: journalFullSync})
+		records++
+	}
+	for _, action := range journal.Pending() {
+		writeRecord(writer, offerRecord(action))
+		records++
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, journal.path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(journal.path))
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if journal.file != nil {
+		journal.file.Close()
+	}
+	journal.file = file
+	journal.writer = writer
+	journal.records = records
+	journal.dirty = false
+	return nil
+}
+
+func offerRecord(action Action) journalRecord {
+	return journalRecord{Op: journalOffer, ID: action.id, Method: action.Method, Path: action.Path, From: action.From, IsDir: action.IsDir, Timestamp: action.Timestamp, Since: action.Since}
+}
+
+func writeRecord(writer *bufio.Writer, record journalRecord) {
+	data, _ := json.Marshal(record)
+	writer.Write(data)
+	writer.WriteByte('\n')
+}
+
+// 重命名后同步所在目录，保证崩溃后看到的是新的日志文件
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// 追加一条记录，立即写入文件以免进程退出时丢失，由Sync批量同步到磁盘
+func (journal *Journal) append(record journalRecord) {
+	writeRecord(journal.writer, record)
+	err := journal.writer.Flush()
+	if err != nil {
+		logrus.WithError(err).Errorf("Write journal %s failed.", journal.path)
+	}
+	journal.dirty = true
+	journal.records++
+	if journal.records > journalCompactThreshold && journal.records > 2*len(journal.pending) {
+		err := journal.rewrite()
+		if err != nil {
+			logrus.WithError(err).Errorf("Compact journal %s failed.", journal.path)
+		}
+	}
+}
+
+// 将已写入的记录同步到磁盘。监听协程处理完一批事件后调用，一批变更只需要一次fsync；
+// 任务完成的记录丢失只会导致重复同步，不需要单独同步。
+func (journal *Journal) Sync() error {
+	if journal == nil {
+		return nil
+	}
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	if !journal.dirty {
+		return nil
+	}
+	err := journal.file.Sync()
+	if err != nil {
+		logrus.WithError(err).Errorf("Sync journal %s failed.", journal.path)
+		return err
+	}
+	journal.dirty = false
+	return nil
+}
+
+// 未完成的任务，按入队顺序排列
+func (journal *Journal) Pending() []Action {
+	actions := make([]Action, 0, len(journal.pending))
+	for _, action := range journal.pending {
+		actions = append(actions, action)
+	}
+	sort.Slice(actions, func(i, j int) bool {
+		return actions[i].id < actions[j].id
+	})
+	return actions
+}
+
+// 日志中最大的任务序号，恢复后新的任务从这个序号之后继续编号
+func (journal *Journal) Seq() uint64 {
+	return journal.seq
+}
+
+func (journal *Journal) FullSyncPending() bool {
+	return journal.fullSync
+}
+
+// 记录入队的任务
+func (journal *Journal) Offer(action Action) {
+	if journal == nil {
+		return
+	}
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	if action.id > journal.seq {
+		journal.seq = action.id
+	}
+	journal.pending[action.id] = action
+	journal.append(offerRecord(action))
+}
+
+// 记录任务已完成或被丢弃
+func (journal *Journal) Done(action Action) {
+	if journal == nil {
+		return
+	}
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	if _, ok := journal.pending[action.id]; !ok {
+		return
+	}
+	delete(journal.pending, action.id)
+	journal.append(journalRecord{Op: journalDone, ID: action.id})
+}
+
+func (journal *Journal) FullSync(scheduled bool) {
+	if journal == nil {
+		return
+	}
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	if journal.fullSync == scheduled {
+		return
+	}
+	journal.fullSync = scheduled
+	if scheduled {
+		journal.append(journalRecord{Op: journalFullSync})
+	} else {
+		journal.append(journalRecord{Op: journalFullSyncDone})
+	}
+}
+
+func (journal *Journal) Close() error {
+	if journal == nil {
+		return nil
+	}
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	journal.writer.Flush()
+	journal.file.Sync()
+	return journal.file.Close()
+}
@@ -0,0 +1,181 @@
+package watcher
+
+import (
+	"gosync/conf"
+	"gosync/internal/dest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 持续有未完成的任务时日志也要被压缩，重新打开后恢复的是最新的未完成任务
+func TestJournalCompactsWithPendingActions(t *testing.T) {
+	dir := t.TempDir()
+	journal, exists, err := OpenJournal(dir, "data/backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("journal should not exist")
+	}
+	const inflight = 100
+	for id := uint64(1); id <= 3*journalCompactThreshold; id++ {
+		journal.Offer(Action{Method: WRITE, Path: "file", id: id})
+		if id > inflight {
+			journal.Done(Action{id: id - inflight})
+		}
+	}
+	if journal.records > journalCompactThreshold+1 {
+		t.Errorf("journal has %d records, want at most %d", journal.records, journalCompactThreshold+1)
+	}
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	journal, exists, err = OpenJournal(dir, "data/backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	if !exists {
+		t.Fatal("journal should exist")
+	}
+	pending := journal.Pending()
+	if len(pending) != inflight {
+		t.Fatalf("restored %d actions, want %d", len(pending), inflight)
+	}
+	if first := pending[0].id; first != 3*journalCompactThreshold-inflight+1 {
+		t.Errorf("first restored action is %d", first)
+	}
+	if journal.Seq() != 3*journalCompactThreshold {
+		t.Errorf("seq is %d", journal.Seq())
+	}
+}
+
+func TestJournalFullSync(t *testing.T) {
+	dir := t.TempDir()
+	journal, _, err := OpenJournal(dir, "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.FullSync(true)
+	journal.Close()
+	journal, _, err = OpenJournal(dir, "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !journal.FullSyncPending() {
+		t.Error("full sync should be pending after reopen")
+	}
+	journal.FullSync(false)
+	journal.Close()
+	journal, _, err = OpenJournal(dir, "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	if journal.FullSyncPending() {
+		t.Error("full sync should be done after reopen")
+	}
+}
+
+// 写入的记录由Sync批量同步到磁盘，没有新的记录时不需要再次同步
+func TestJournalSync(t *testing.T) {
+	journal, _, err := OpenJournal(t.TempDir(), "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	if journal.dirty {
+		t.Error("new journal should be synced")
+	}
+	for id := uint64(1); id <= 3; id++ {
+		journal.Offer(Action{Method: WRITE, Path: "file", id: id})
+	}
+	journal.Done(Action{id: 1})
+	if !journal.dirty {
+		t.Error("journal should wait for sync after offers")
+	}
+	if err := journal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if journal.dirty {
+		t.Error("journal should be synced")
+	}
+}
+
+// 合并时新任务先于被丢弃的任务写入日志，日志在任意一条记录处截断后恢复的任务仍然覆盖所有变更
+func TestJournalOfferBeforeDrops(t *testing.T) {
+	dir := t.TempDir()
+	fake := dest.NewFake("data", &conf.RsyncConfig{Name: "data", RootPath: t.TempDir() + "/", AllowDelete: true})
+	queue, err := CreateQueue(&conf.QueueConfig{StateDir: dir, Workers: 1}, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.offer(WRITE, "dir/a")
+	queue.offer(WRITE, "dir/b")
+	queue.offer(DELETE, "dir/")
+	queue.offerRename("old", "dir/")
+	queue.Close()
+	data, err := os.ReadFile(filepath.Join(dir, "data.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("journal has %d records: %s", len(lines), data)
+	}
+	for n := 2; n <= len(lines); n++ {
+		crashed := t.TempDir()
+		if err := os.WriteFile(filepath.Join(crashed, "data.journal"), []byte(strings.Join(lines[:n], "")), 0600); err != nil {
+			t.Fatal(err)
+		}
+		journal, _, err := OpenJournal(crashed, "data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending := map[string]bool{}
+		for _, action := range journal.Pending() {
+			pending[action.String()] = true
+		}
+		journal.Close()
+		covered := pending["RENAME old -> dir/"] || pending["DELETE dir/"] || (pending["WRITE dir/a"] && pending["WRITE dir/b"])
+		if !covered {
+			t.Errorf("changes lost after %d records: %v", n, pending)
+		}
+	}
+}
+
+// 重写失败时继续使用原来的日志文件
+func TestJournalRewriteFailureKeepsFile(t *testing.T) {
+	dir := t.TempDir()
+	journal, _, err := OpenJournal(dir, "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Offer(Action{Method: WRITE, Path: "a", id: 1})
+	// 临时文件的位置被目录占用，无法创建
+	tmp := filepath.Join(dir, "data.journal.tmp")
+	if err := os.MkdirAll(filepath.Join(tmp, "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.rewrite(); err == nil {
+		t.Fatal("rewrite should fail")
+	}
+	journal.Offer(Action{Method: WRITE, Path: "b", id: 2})
+	if err := journal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(tmp)
+	journal, _, err = OpenJournal(dir, "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	if pending := journal.Pending(); len(pending) != 2 || pending[1].Path != "b" {
+		t.Errorf("restored %v", pending)
+	}
+}
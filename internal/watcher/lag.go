@@ -0,0 +1,66 @@
+package watcher
+
+import (
+	"gosync/internal/metrics"
+	"time"
+)
+
+// 任务同步完成，记录从变更发生到同步完成的延迟
+func (queue *Queue) synced(since int64) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.observeLatency(since)
+}
+
+// 需要持有mu
+func (queue *Queue) observeLatency(since int64) {
+	if since <= 0 {
+		return
+	}
+	latency := time.Since(time.UnixMilli(since))
+	metrics.ReplicationLatency.Observe(latency.Seconds(), queue.name)
+	queue.maxLatency = max(queue.maxLatency, latency)
+}
+
+// 任务被全量同步取代，延迟从最早的变更开始计算，到全量同步完成为止
+func (queue *Queue) coveredByFullSync(actions []Action) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	for _, action := range actions {
+		if queue.fullSyncSince == 0 || action.Since < queue.fullSyncSince {
+			queue.fullSyncSince = action.Since
+		}
+	}
+}
+
+// 最早的未同步变更的时间，包括队列中、执行中和被全量同步取代的任务，没有时返回零值
+func (queue *Queue) OldestUnsynced() time.Time {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return queue.oldestUnsynced()
+}
+
+func (queue *Queue) oldestUnsynced() time.Time {
+	oldest := queue.fullSyncSince
+	for _, actions := range [][]Action{queue.state.pending, queue.state.inflight, queue.actions} {
+		for _, action := range actions {
+			if oldest == 0 || action.Since < oldest {
+				oldest = action.Since
+			}
+		}
+	}
+	if oldest == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(oldest)
+}
+
+// 返回上次调用以来同步完成的变更的最大延迟，并重新开始统计。
+// 两次检查之间发生并完成的延迟不会体现在OldestUnsynced中，需要通过该值补充。
+func (queue *Queue) TakeMaxLatency() time.Duration {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	latency := queue.maxLatency
+	queue.maxLatency = 0
+	return latency
+}
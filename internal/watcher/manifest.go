@@ -0,0 +1,362 @@
+package watcher
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 变更记录超过该数量时合并到清单文件
+const manifestCompactThreshold = 1000000
+
+type manifestEntry struct {
+	path  string
+	state fileState
+}
+
+// 已同步到远端的文件清单，记录每个路径的大小、修改时间和inode，重启时与目录树比较，只同步有差异的路径。
+// 清单文件按walkTree的遍历顺序排序，比较时两边流式归并，不需要把整个目录树加载到内存。
+// 同步完成的变更先追加到.log文件，启动时或记录过多时再合并到清单文件。
+type Manifest struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	writer  *bufio.Writer
+	records int
+	exists  bool
+}
+
+// 打开文件清单并合并上次运行时的变更记录，清单文件不存在时需要先执行一次全量同步
+func OpenManifest(dir string, name string) (*Manifest, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{path: filepath.Join(dir, strings.ReplaceAll(name, "/", "-")+".manifest")}
+	_, err = os.Stat(manifest.path)
+	manifest.exists = err == nil
+	err = manifest.compact()
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// 是否有可用的清单，只有全量同步成功后才会生成清单
+func (manifest *Manifest) Exists() bool {
+	return manifest != nil && manifest.exists
+}
+
+// 将变更记录合并到清单文件，并重新打开一个空的变更记录文件
+func (manifest *Manifest) compact() error {
+	if manifest.file != nil {
+		manifest.writer.Flush()
+		manifest.file.Close()
+		manifest.file = nil
+	}
+	logPath := manifest.path + ".log"
+	if manifest.exists {
+		err := manifest.merge(logPath)
+		if err != nil {
+			return err
+		}
+	}
+	// 没有清单时变更记录没有意义，直接丢弃
+	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	manifest.file = file
+	manifest.writer = bufio.NewWriter(file)
+	manifest.records = 0
+	return nil
+}
+
+func (manifest *Manifest) merge(logPath string) error {
+	// 变更记录按行号排序，删除的记录会覆盖之前设置的路径及其子路径
+	sets := map[string]int{}
+	states := map[string]fileState{}
+	removes := map[string]int{}
+	if file, err := os.Open(logPath); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			text := scanner.Text()
+			if len(text) < 2 {
+				continue
+			}
+			path, state, ok := parseManifestLine(text[2:])
+			if !ok {
+				// 进程崩溃时最后一行可能没有写完整
+				logrus.Warnf("Skip broken manifest record in %s: %s", logPath, text)
+				continue
+			}
+			switch text[0] {
+			case '+':
+				sets[path] = line
+				states[path] = state
+			case '-':
+				removes[path] = line
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if len(sets) == 0 && len(removes) == 0 {
+		return nil
+	}
+
+	removed := func(path string, after int) bool {
+		for i := 0; i < len(path); i++ {
+			if path[i] == '/' && removes[path[:i+1]] > after {
+				return true
+			}
+		}
+		return removes[path] > after
+	}
+	updates := []manifestEntry{}
+	for path, line := range sets {
+		if !removed(path, line) {
+			updates = append(updates, manifestEntry{path: path, state: states[path]})
+		}
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return manifestCompare(updates[i].path, updates[j].path) < 0
+	})
+
+	reader, err := openManifestReader(manifest.path)
+	if err != nil {
+		return err
+	}
+	defer reader.close()
+	return writeManifest(manifest.path, func(write func(string, fileState)) error {
+		i := 0
+		for path, state, ok := reader.next(); ok; path, state, ok = reader.next() {
+			for ; i < len(updates) && manifestCompare(updates[i].path, path) < 0; i++ {
+				write(updates[i].path, updates[i].state)
+			}
+			if _, ok := sets[path]; ok || removed(path, 0) {
+				continue
+			}
+			write(path, state)
+		}
+		for ; i < len(updates); i++ {
+			write(updates[i].path, updates[i].state)
+		}
+		return reader.err()
+	})
+}
+
+// 记录同步完成的路径，removed中的目录会同时移除其子路径
+func (manifest *Manifest) Record(removed []string, synced []manifestEntry) {
+	if !manifest.Exists() {
+		return
+	}
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	for _, path := range removed {
+		manifest.writer.WriteString("- " + formatManifestLine(path, fileState{}))
+	}
+	for _, entry := range synced {
+		manifest.writer.WriteString("+ " + formatManifestLine(entry.path, entry.state))
+	}
+	err := manifest.writer.Flush()
+	if err != nil {
+		logrus.WithError(err).Errorf("Write manifest %s failed.", manifest.path)
+	}
+	manifest.records += len(removed) + len(synced)
+	if manifest.records > manifestCompactThreshold {
+		err := manifest.compact()
+		if err != nil {
+			logrus.WithError(err).Errorf("Compact manifest %s failed.", manifest.path)
+		}
+	}
+}
+
+// 全量同步开始前生成新的清单，同步期间修改的文件修改时间会晚于清单中的记录，下次比较时仍会被同步
+func (manifest *Manifest) Prepare(walk func(fn func(string, fileState)) error) error {
+	if manifest == nil {
+		return nil
+	}
+	return writeManifest(manifest.path+".next", walk)
+}
+
+// 全量同步成功后启用新的清单，之前的变更记录已经包含在全量同步中
+func (manifest *Manifest) Commit() error {
+	if manifest == nil {
+		return nil
+	}
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	err := os.Rename(manifest.path+".next", manifest.path)
+	if err != nil {
+		return err
+	}
+	manifest.exists = true
+	manifest.writer.Flush()
+	manifest.file.Close()
+	manifest.file = nil
+	os.Remove(manifest.path + ".log")
+	return manifest.compact()
+}
+
+// 按遍历顺序将目录树与清单归并比较，报告新增或修改的路径以及已经不存在的路径
+func (manifest *Manifest) Diff(walk func(fn func(string, fileState)) error, changed func(string, fileState), deleted func(string)) error {
+	reader, err := openManifestReader(manifest.path)
+	if err != nil {
+		return err
+	}
+	defer reader.close()
+	path, state, ok := reader.next()
+	err = walk(func(current string, currentState fileState) {
+		for ; ok && manifestCompare(path, current) < 0; path, state, ok = reader.next() {
+			deleted(path)
+		}
+		if ok && path == current {
+			if currentState != state && !currentState.IsDir {
+				changed(current, currentState)
+			}
+			path, state, ok = reader.next()
+			return
+		}
+		changed(current, currentState)
+	})
+	if err != nil {
+		return err
+	}
+	for ; ok; path, state, ok = reader.next() {
+		deleted(path)
+	}
+	return reader.err()
+}
+
+func (manifest *Manifest) Close() error {
+	if manifest == nil {
+		return nil
+	}
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	manifest.writer.Flush()
+	return manifest.file.Close()
+}
+
+// 清单的排序规则，把/视为最小的字符，使目录紧跟在同级的同名前缀之前，与WalkDir的遍历顺序一致
+func manifestCompare(a string, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		if a[i] == '/' {
+			return -1
+		}
+		if b[i] == '/' {
+			return 1
+		}
+		if a[i] < b[i] {
+			return -1
+		}
+		return 1
+	}
+	return len(a) - len(b)
+}
+
+// 路径可能包含空格或换行，使用带引号的格式保存
+func formatManifestLine(path string, state fileState) string {
+	return strconv.Quote(path) + " " + strconv.FormatInt(state.Size, 10) + " " + strconv.FormatInt(state.Mtime, 10) + " " + strconv.FormatUint(state.Inode, 10) + "\n"
+}
+
+func parseManifestLine(line string) (string, fileState, bool) {
+	quoted, err := strconv.QuotedPrefix(line)
+	if err != nil {
+		return "", fileState{}, false
+	}
+	path, err := strconv.Unquote(quoted)
+	if err != nil {
+		return "", fileState{}, false
+	}
+	fields := strings.Fields(line[len(quoted):])
+	if len(fields) != 3 {
+		return "", fileState{}, false
+	}
+	state := fileState{IsDir: strings.HasSuffix(path, "/")}
+	var err1, err2, err3 error
+	state.Size, err1 = strconv.ParseInt(fields[0], 10, 64)
+	state.Mtime, err2 = strconv.ParseInt(fields[1], 10, 64)
+	state.Inode, err3 = strconv.ParseUint(fields[2], 10, 64)
+	return path, state, err1 == nil && err2 == nil && err3 == nil
+}
+
+// 写入临时文件后替换，写入过程中崩溃不会破坏原有的清单
+func writeManifest(path string, entries func(write func(string, fileState)) error) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriterSize(file, 1024*1024)
+	err = entries(func(path string, state fileState) {
+		writer.WriteString(formatManifestLine(path, state))
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+type manifestReader struct {
+	file    *os.File
+	scanner *bufio.Scanner
+}
+
+func openManifestReader(path string) (*manifestReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	return &manifestReader{file: file, scanner: scanner}, nil
+}
+
+func (reader *manifestReader) next() (string, fileState, bool) {
+	for reader.scanner.Scan() {
+		path, state, ok := parseManifestLine(reader.scanner.Text())
+		if ok {
+			return path, state, true
+		}
+		logrus.Warnf("Skip broken manifest record in %s: %s", reader.file.Name(), reader.scanner.Text())
+	}
+	return "", fileState{}, false
+}
+
+func (reader *manifestReader) err() error {
+	return reader.scanner.Err()
+}
+
+func (reader *manifestReader) close() {
+	reader.file.Close()
+}
@@ -1,11 +1,16 @@
 package watcher
 
 import (
+	"context"
 	"fmt"
 	"gosync/conf"
-	"gosync/internal/rsync"
+	"gosync/internal/dest"
+	"gosync/internal/metrics"
+	"gosync/internal/tree"
+	"io/fs"
 	"math"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bmatcuk/doublestar/v4"
@@ -16,13 +21,18 @@ const (
 	CREATE = 1
 	WRITE  = 2
 	DELETE = 3
+	RENAME = 4
+	ATTRIB = 5 // 只有权限、属主、修改时间等属性发生变化
 )
 
 type Action struct {
 	Method    int
 	Path      string
+	From      string // RENAME的原路径
 	IsDir     bool
 	Timestamp int64
+	Since     int64 // 覆盖的最早一次变更的时间，被合并的任务的时间会延续到新的任务
+	id        uint64
 }
 
 func (action Action) String() string {
@@ -34,6 +44,10 @@ func (action Action) String() string {
 		str += "WRITE "
 	case DELETE:
 		str += "DELETE "
+	case RENAME:
+		str += "RENAME " + action.From + " -> "
+	case ATTRIB:
+		str += "ATTRIB "
 	default:
 		return "UNKNOWN"
 	}
@@ -44,25 +58,263 @@ func (action Action) String() string {
 	return str
 }
 
+// 变更在队列中停留该时长后才会被同步，以便合并短时间内的连续变更
+const settleTime = 100 * time.Millisecond
+
+// 同步任务队列，offer由监听协程调用，ScheduleFullSync由定时任务调用，Start在独立的协程中消费队列。
+// actions、fullSync等状态由mu保护，状态变化时通过wakeup唤醒消费协程。
+// 重新加载配置时config和client会被替换，被替换的client在没有执行中的任务后关闭。
 type Queue struct {
-	config   *conf.QueueConfig
-	actions  *[]Action
-	fullSync bool
+	name        string
+	config      *conf.QueueConfig
+	client      dest.Destination
+	retired     []dest.Destination
+	journal     *Journal
+	manifest    *Manifest
+	restored    bool
+	mu          sync.Mutex
+	actions     []Action
+	fullSync    bool
+	fullSyncSeq uint64
+	seq         uint64
+	wakeup      chan struct{}
+	done        chan struct{}
+	paused      bool
+	retryNow    bool
+	// 被全量同步覆盖的任务中最早的变更时间，以及上次查询以来同步完成的变更的最大延迟
+	fullSyncSince int64
+	maxLatency    time.Duration
+	// 消费协程发布的运行状态，供控制接口查询
+	state loopState
+}
+
+func CreateQueue(c *conf.QueueConfig, client dest.Destination) (*Queue, error) {
+	queue := &Queue{
+		name:    client.Name(),
+		config:  c,
+		client:  client,
+		actions: []Action{},
+		wakeup:  make(chan struct{}, 1),
+	}
+	client.SetReporter(queue.transferred)
+	if c.StateDir != "" {
+		journal, exists, err := OpenJournal(c.StateDir, client.Name())
+		if err != nil {
+			return queue, err
+		}
+		queue.journal = journal
+		queue.restored = exists
+		if exists {
+			// 恢复上次未完成的任务
+			queue.actions = journal.Pending()
+			queue.seq = journal.Seq()
+			queue.fullSync = journal.FullSyncPending()
+			logrus.Infof("Restored %d pending sync tasks of %s from journal.", len(queue.actions), client.Name())
+			queue.updateDepth()
+		}
+		if client.Config().FullSync == "reconcile" {
+			manifest, err := OpenManifest(c.StateDir, client.Name())
+			if err != nil {
+				return queue, err
+			}
+			queue.manifest = manifest
+		}
+	}
+	return queue, nil
+}
+
+// 是否从变更日志中恢复了上次的同步状态，恢复后启动时不需要再执行全量同步
+func (queue *Queue) Restored() bool {
+	return queue.restored
+}
+
+func (queue *Queue) Close() error {
+	queue.mu.Lock()
+	for _, client := range append(queue.retired, queue.client) {
+		client.Close()
+	}
+	queue.retired = nil
+	queue.mu.Unlock()
+	queue.manifest.Close()
+	return queue.journal.Close()
+}
+
+// 重新加载配置后替换同步参数，workers和state-dir需要重启才能生效
+func (queue *Queue) SetConfig(c *conf.QueueConfig) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.config = c
+	queue.notify()
+}
+
+// 重新加载配置后替换远端的客户端，执行中的任务仍使用原来的客户端
+func (queue *Queue) SetClient(client dest.Destination) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.retired = append(queue.retired, queue.client)
+	queue.client = client
+	client.SetReporter(queue.transferred)
+	queue.notify()
+}
+
+// 当前的同步参数和远端的客户端
+func (queue *Queue) current() (*conf.QueueConfig, dest.Destination) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return queue.config, queue.client
+}
+
+// 关闭已经被替换的客户端，只能在没有执行中的任务时调用
+func (queue *Queue) closeRetired() {
+	queue.mu.Lock()
+	retired := queue.retired
+	queue.retired = nil
+	queue.mu.Unlock()
+	for _, client := range retired {
+		client.Close()
+	}
+}
+
+// 将目录树与上次的文件清单比较，只同步有差异的路径。没有清单或比较失败时返回false，需要执行全量同步。
+func (queue *Queue) Reconcile() bool {
+	if !queue.manifest.Exists() {
+		logrus.Infof("No manifest of %s found, a full sync is required.", queue.name)
+		return false
+	}
+	_, client := queue.current()
+	config := client.Config()
+	includes, err := client.WatchFolders()
+	if err != nil {
+		logrus.WithError(err).Error("Eval watch scope error")
+		return false
+	}
+	logrus.Infof("Starting reconcile %s with manifest ...", queue.name)
+	changes, deletes := 0, 0
+	err = queue.manifest.Diff(func(fn func(string, fileState)) error {
+		return walkTree(config, includes, config.RootPath, "", fn)
+	}, func(path string, state fileState) {
+		changes++
+		if state.IsDir {
+			queue.offer(CREATE, path)
+		} else {
+			queue.offer(WRITE, path)
+		}
+	}, func(path string) {
+		// 清单中可能有之后才被排除或不在监听范围的路径
+		if config.AllowDelete && !tree.Excluded(config.Excludes, path) && tree.ShouldWatch(includes, path) {
+			deletes++
+			queue.offer(DELETE, path)
+		}
+	})
+	queue.journal.Sync()
+	if err != nil {
+		logrus.WithError(err).Errorf("Reconcile %s failed, a full sync will be performed.", queue.name)
+		return false
+	}
+	logrus.Infof("Reconcile %s completed, %d changed and %d deleted paths found.", queue.name, changes, deletes)
+	return true
+}
+
+// 遍历本地目录树中在监听范围内的路径，watchFolders可能执行外部命令，同一批任务应共用一次结果
+func walk(config *conf.RsyncConfig, watchFolders func() ([]string, error), dir string, fn func(string, fileState)) error {
+	includes, err := watchFolders()
+	if err != nil {
+		return err
+	}
+	return walkTree(config, includes, config.RootPath, dir, fn)
+}
+
+// 同步成功后将路径的当前状态记录到文件清单
+func (queue *Queue) record(client dest.Destination, actions []Action) {
+	if !queue.manifest.Exists() || len(actions) == 0 {
+		return
+	}
+	removed := []string{}
+	synced := []manifestEntry{}
+	watchFolders := sync.OnceValues(client.WatchFolders)
+	for _, action := range actions {
+		if action.Method == ATTRIB && action.IsDir {
+			continue
+		}
+		if action.Method == RENAME {
+			removed = append(removed, action.From)
+		}
+		if action.Method == DELETE || action.IsDir {
+			removed = append(removed, action.Path)
+		}
+		if action.Method == DELETE {
+			continue
+		}
+		if action.IsDir {
+			err := walk(client.Config(), watchFolders, action.Path, func(path string, state fileState) {
+				synced = append(synced, manifestEntry{path: path, state: state})
+			})
+			if err != nil {
+				logrus.WithError(err).Warnf("Scan %s failed.", action.Path)
+			}
+		} else if info, err := statPath(client.Config(), action.Path); err == nil {
+			// 不同步的符号链接也不记录到清单
+			if info.Mode()&fs.ModeSymlink == 0 || client.Config().Symlinks != "skip" {
+				synced = append(synced, manifestEntry{path: action.Path, state: statOf(info)})
+			}
+		} else {
+			removed = append(removed, action.Path)
+		}
+	}
+	queue.manifest.Record(removed, synced)
+}
+
+// 唤醒消费协程，不会阻塞
+func (queue *Queue) notify() {
+	select {
+	case queue.wakeup <- struct{}{}:
+	default:
+	}
 }
 
-func CreateQueue(c *conf.QueueConfig) Queue {
-	return Queue{
-		config:   c,
-		actions:  &[]Action{},
-		fullSync: false,
+// 重命名可以复用远端已有的数据，会丢弃对新路径的同步任务
+func (queue *Queue) offerRename(from string, to string) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	isDir := strings.HasSuffix(to, "/")
+	now := time.Now().UnixMilli()
+	since := now
+	drops := ""
+	dropped := []Action{}
+	for i := len(queue.actions) - 1; i >= 0; i-- {
+		action := queue.actions[i]
+		if action.Method != CREATE && action.Method != WRITE {
+			continue
+		}
+		if action.Path == to || (isDir && isParent(to, action.Path)) {
+			drops = fmt.Sprintf("\n    - %+v (drop)%s", action, drops)
+			since = min(since, action.Since)
+			queue.actions = append(queue.actions[:i], queue.actions[i+1:]...)
+			dropped = append(dropped, action)
+			metrics.QueueDropped.Inc(queue.name, methodName(action.Method))
+		}
+	}
+	queue.seq++
+	action := Action{Method: RENAME, Path: to, From: from, IsDir: isDir, Timestamp: now, Since: since, id: queue.seq}
+	logrus.Debugf("%s%s", logStr(RENAME, from+" -> "+to, isDir), drops)
+	queue.journal.Offer(action)
+	// 新任务先于被丢弃的任务写入日志，崩溃后不会只留下丢弃的记录
+	for _, drop := range dropped {
+		queue.journal.Done(drop)
 	}
+	queue.actions = append(queue.actions, action)
+	metrics.QueueOffered.Inc(queue.name, methodName(RENAME))
+	queue.updateDepth()
+	queue.notify()
 }
 
 func (queue *Queue) offer(method int, path string) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
 	now := time.Now().UnixMilli()
 	isDir := strings.HasSuffix(path, "/")
 	ignore := false
-	for _, action := range *queue.actions {
+	for _, action := range queue.actions {
 		if method == CREATE {
 			if action.Method == CREATE {
 				if action.IsDir && isParent(action.Path, path) {
@@ -89,15 +341,31 @@ func (queue *Queue) offer(method int, path string) {
 					break
 				}
 			}
+		} else if method == ATTRIB {
+			// 同步内容时会一并同步属性
+			if action.Method == CREATE && action.IsDir && isParent(action.Path, path) {
+				ignore = true
+				break
+			} else if (action.Method == CREATE || action.Method == WRITE || action.Method == ATTRIB) && action.Path == path {
+				ignore = true
+				break
+			}
 		}
 	}
 	if ignore {
 		logrus.Debugf("%s (ignore)", logStr(method, path, isDir))
+		metrics.QueueIgnored.Inc(queue.name, methodName(method))
 	} else {
 		drops := ""
-		for i := len(*queue.actions) - 1; i >= 0; i-- {
+		dropped := []Action{}
+		since := now
+		for i := len(queue.actions) - 1; i >= 0; i-- {
 			drop := false
-			action := (*queue.actions)[i]
+			action := queue.actions[i]
+			if action.Method == RENAME {
+				// 重命名同时涉及远端的原路径，不能被丢弃
+				continue
+			}
 			if method == CREATE {
 				if isDir {
 					if isParent(path, action.Path) {
@@ -125,11 +393,23 @@ func (queue *Queue) offer(method int, path string) {
 			}
 			if drop {
 				drops = fmt.Sprintf("\n    - %+v (drop)%s", action, drops)
-				*queue.actions = append((*queue.actions)[:i], (*queue.actions)[i+1:]...)
+				since = min(since, action.Since)
+				queue.actions = append(queue.actions[:i], queue.actions[i+1:]...)
+				dropped = append(dropped, action)
+				metrics.QueueDropped.Inc(queue.name, methodName(action.Method))
 			}
 		}
 		logrus.Debugf("%s%s", logStr(method, path, isDir), drops)
-		*queue.actions = append((*queue.actions), Action{Method: method, Path: path, IsDir: isDir, Timestamp: now})
+		queue.seq++
+		action := Action{Method: method, Path: path, IsDir: isDir, Timestamp: now, Since: since, id: queue.seq}
+		queue.journal.Offer(action)
+		for _, drop := range dropped {
+			queue.journal.Done(drop)
+		}
+		queue.actions = append(queue.actions, action)
+		metrics.QueueOffered.Inc(queue.name, methodName(method))
+		queue.updateDepth()
+		queue.notify()
 	}
 }
 
@@ -138,6 +418,23 @@ func isParent(folder string, path string) bool {
 	return ok && err == nil
 }
 
+// 指标中使用的动作类型名称
+func methodName(method int) string {
+	switch method {
+	case CREATE:
+		return "create"
+	case WRITE:
+		return "write"
+	case DELETE:
+		return "delete"
+	case RENAME:
+		return "rename"
+	case ATTRIB:
+		return "attrib"
+	}
+	return "unknown"
+}
+
 func logStr(method int, path string, isDir bool) string {
 	log := ""
 	switch method {
@@ -147,6 +444,10 @@ func logStr(method int, path string, isDir bool) string {
 		log = "Write "
 	case DELETE:
 		log = "Delete "
+	case RENAME:
+		log = "Rename "
+	case ATTRIB:
+		log = "Attrib "
 	}
 	if isDir {
 		log += "folder"
@@ -156,94 +457,243 @@ func logStr(method int, path string, isDir bool) string {
 	return log + ": " + path
 }
 
-func (queue *Queue) take() []Action {
+// 取出已经超过合并等待时间的任务，并返回下一个任务还需要等待的时长，0表示队列已空
+func (queue *Queue) take() ([]Action, time.Duration) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
 	now := time.Now().UnixMilli()
-	for i, action := range *queue.actions {
-		if now-action.Timestamp < 100 {
-			actions := (*queue.actions)[:i]
-			*queue.actions = (*queue.actions)[i:]
-			return actions
+	for i, action := range queue.actions {
+		if age := time.Duration(now-action.Timestamp) * time.Millisecond; age < settleTime {
+			actions := queue.actions[:i:i]
+			queue.actions = queue.actions[i:]
+			return actions, settleTime - age
 		}
 	}
-	actions := *queue.actions
-	*queue.actions = []Action{}
-	return actions
+	actions := queue.actions
+	queue.actions = []Action{}
+	return actions, 0
 }
 
-func (queue *Queue) Start() {
+// 消费队列直到ctx被取消。取消后继续同步队列中的变更，直到队列排空或超过drain-timeout，
+// 超时后中止执行中的rsync，未完成的任务保留在队列和变更日志中。
+func (queue *Queue) Start(ctx context.Context) {
 	actions := []Action{}
-	retryInterval, _ := time.ParseDuration(queue.config.RetryInterval)
-	waitRetry := int64(0)
+	running := map[int][]Action{}
+	config, _ := queue.current()
+	workers := config.Workers
+	tasks := make(chan task, workers)
+	results := make(chan result, workers)
+	// rsync使用单独的abortCtx，排空超时后才会被取消
+	abortCtx, abort := context.WithCancel(context.Background())
+	defer abort()
+	context.AfterFunc(ctx, func() {
+		config, _ := queue.current()
+		drainTimeout, _ := time.ParseDuration(config.DrainTimeout)
+		logrus.Infof("Stopping sync queue of %s, waiting at most %s for the remaining tasks...", queue.name, drainTimeout)
+		time.AfterFunc(drainTimeout, abort)
+	})
+	for i := 0; i < workers; i++ {
+		go queue.work(abortCtx, tasks, results)
+	}
+	nextTask := 0
+	var retryAt time.Time
 	for {
-		actions = append(actions, queue.take()...)
-		if queue.fullSync {
+		config, client := queue.current()
+		retryInterval, _ := time.ParseDuration(config.RetryInterval)
+		stopping, aborted := ctx.Err() != nil, abortCtx.Err() != nil
+		paused, retryNow := queue.controls()
+		if retryNow {
+			retryAt = time.Time{}
+		}
+		if len(running) == 0 {
+			queue.closeRetired()
+		}
+		ready, wait := queue.take()
+		actions = append(actions, ready...)
+		fullSync, fullSyncSeq := queue.fullSyncPending()
+		if fullSync {
 			if len(actions) > 0 {
 				log := ""
 				for _, action := range actions {
 					log += fmt.Sprintf("\n    - %+v (drop)", action)
+					queue.journal.Done(action)
 				}
+				queue.coveredByFullSync(actions)
 				logrus.Debugf("Ignore sync task, waiting for full sync execution.%s", log)
 				actions = []Action{}
 			}
 		} else {
-			if len(actions) > queue.config.Capacity {
-				logrus.Warnf("The size of sync task queue exceeds %d, it will be converted to perform full sync.", queue.config.Capacity)
-				queue.fullSync = true
+			if len(actions) > config.Capacity {
+				logrus.Warnf("The size of sync task queue of %s exceeds %d, it will be converted to perform full sync.", queue.name, config.Capacity)
+				metrics.CapacityFallbacks.Inc(queue.name)
+				queue.ScheduleFullSync()
+				fullSync, fullSyncSeq = queue.fullSyncPending()
+				for _, action := range actions {
+					queue.journal.Done(action)
+				}
+				queue.coveredByFullSync(actions)
 				actions = []Action{}
 			}
 		}
-		if waitRetry == 0 || time.Now().UnixMilli() > waitRetry {
-			waitRetry = 0
-			if queue.fullSync {
-				if rsync.FullSync() {
-					queue.fullSync = false
+		// 停止时等待执行中的任务结束，队列已经排空、暂停或者超时后退出，等待执行的全量同步留到下次启动
+		if stopping && len(running) == 0 && (aborted || paused || (len(actions) == 0 && wait == 0)) {
+			break
+		}
+		if retryAt.IsZero() || !time.Now().Before(retryAt) {
+			retryAt = time.Time{}
+			// 全量同步需要等待正在执行的任务完成
+			if fullSync && len(running) == 0 && !stopping && !paused {
+				// 在同步开始前生成新的文件清单
+				prepared := false
+				if queue.manifest != nil {
+					err := queue.manifest.Prepare(func(fn func(string, fileState)) error {
+						return walk(client.Config(), client.WatchFolders, "", fn)
+					})
+					if err != nil {
+						logrus.WithError(err).Errorf("Prepare manifest of %s failed.", queue.name)
+					}
+					prepared = err == nil
+				}
+				queue.publish(actions, running, time.Time{}, true)
+				err := client.FullSync(abortCtx)
+				queue.finished(err == nil, fmt.Sprintf("full sync failed: %v", err))
+				if err == nil {
+					queue.fullSyncDone(fullSyncSeq)
+					if prepared {
+						err := queue.manifest.Commit()
+						if err != nil {
+							logrus.WithError(err).Errorf("Save manifest of %s failed.", queue.name)
+						}
+					}
 				} else {
-					waitRetry = time.Now().Add(retryInterval).UnixMilli()
-					logrus.Infof("Waiting %d seconds to retry...", int(math.Ceil(retryInterval.Seconds())))
+					retryAt = time.Now().Add(retryInterval)
+					metrics.RetryWaits.Inc(queue.name)
+					logrus.Infof("Waiting %d seconds to retry full sync of %s...", int(math.Ceil(retryInterval.Seconds())), queue.name)
 				}
+				continue
 			}
-			if !queue.fullSync && len(actions) > 0 {
-				errorIndex := -1
-				for i, action := range actions {
-					log := "Starting "
-					if action.Method != DELETE {
-						log += "sync "
-					} else {
-						log += "delete "
-					}
-					if action.IsDir {
-						log += "folder "
-					} else {
-						log += "file "
-					}
-					logrus.Infof("%s: %s ...", log, action.Path)
-					ok := true
-					if action.Method != DELETE {
-						ok = rsync.Sync(action.Path)
-					} else {
-						ok = rsync.Delete(action.Path)
-					}
-					if !ok {
-						errorIndex = i
-						waitRetry = time.Now().Add(retryInterval).UnixMilli()
-						break
-					}
+			if !fullSync && !aborted && !paused && len(actions) > 0 && len(running) < workers {
+				inflight := []Action{}
+				for _, batch := range running {
+					inflight = append(inflight, batch...)
 				}
-				if errorIndex >= 0 {
-					actions = actions[errorIndex:]
-				} else {
-					actions = []Action{}
+				var batches [][]Action
+				batches, actions = schedule(actions, inflight, workers-len(running))
+				for _, batch := range batches {
+					nextTask++
+					running[nextTask] = batch
+					tasks <- task{id: nextTask, client: client, actions: batch}
 				}
-				if waitRetry > 0 {
-					logrus.Infof("Waiting %d seconds to retry... (%d remaining tasks)", int(math.Ceil(retryInterval.Seconds())), len(actions))
+			}
+		}
+
+		// 等待新的变更、任务完成、合并等待或重试间隔结束
+		if !retryAt.IsZero() {
+			if delay := time.Until(retryAt); wait == 0 || delay < wait {
+				wait = delay
+			}
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		queue.publish(actions, running, retryAt, false)
+		var stop, abortion <-chan struct{}
+		if !stopping {
+			stop = ctx.Done()
+		} else if !aborted {
+			abortion = abortCtx.Done()
+		}
+		select {
+		case <-queue.wakeup:
+		case <-timeout:
+		case <-stop:
+		case <-abortion:
+		case r := <-results:
+			// 失败的任务按原顺序放回队列等待重试
+			delete(running, r.id)
+			failures := map[uint64]bool{}
+			for _, action := range r.failed {
+				failures[action.id] = true
+			}
+			for _, action := range r.actions {
+				if !failures[action.id] {
+					queue.journal.Done(action)
+					queue.synced(action.Since)
 				}
 			}
+			if len(r.failed) < len(r.actions) {
+				queue.finished(true, "")
+			}
+			if len(r.failed) > 0 {
+				queue.finished(false, fmt.Sprintf("%s failed (%d of %d): %v", r.failed[0], len(r.failed), len(r.actions), r.err))
+				actions = merge(actions, r.failed)
+				retryAt = time.Now().Add(retryInterval)
+				metrics.RetryWaits.Inc(queue.name)
+				logrus.Infof("Waiting %d seconds to retry %s... (%d remaining tasks)", int(math.Ceil(retryInterval.Seconds())), queue.name, len(actions))
+			}
 		}
-		time.Sleep(100 * time.Millisecond)
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	close(tasks)
+
+	// 未完成的任务放回队列
+	queue.mu.Lock()
+	queue.actions = append(actions, queue.actions...)
+	remaining := len(queue.actions)
+	queue.state.pending = nil
+	queue.state.inflight = nil
+	queue.updateDepth()
+	queue.mu.Unlock()
+	logrus.Infof("Sync queue of %s stopped, %d tasks remaining.", queue.name, remaining)
+}
+
+// 等待队列停止，返回未完成的任务数，等待执行的全量同步也算作一个任务
+func (queue *Queue) Wait() int {
+	if queue.done != nil {
+		<-queue.done
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	remaining := len(queue.actions)
+	if queue.fullSync {
+		remaining++
 	}
+	return remaining
 }
 
 func (queue *Queue) ScheduleFullSync() {
-	logrus.Info("Scheduling to perform full sync...")
+	logrus.Infof("Scheduling to perform full sync of %s...", queue.name)
+	queue.mu.Lock()
 	queue.fullSync = true
+	queue.fullSyncSeq++
+	queue.journal.FullSync(true)
+	queue.mu.Unlock()
+	queue.journal.Sync()
+	queue.notify()
+}
+
+// 是否有等待执行的全量同步，返回的序号用于判断执行期间是否又有新的全量同步请求
+func (queue *Queue) fullSyncPending() (bool, uint64) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return queue.fullSync, queue.fullSyncSeq
+}
+
+// 全量同步成功后清除标记，执行期间有新的请求时保留标记
+func (queue *Queue) fullSyncDone(seq uint64) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if queue.fullSyncSeq == seq {
+		queue.fullSync = false
+		queue.journal.FullSync(false)
+		if queue.fullSyncSince > 0 {
+			queue.observeLatency(queue.fullSyncSince)
+			queue.fullSyncSince = 0
+		}
+	}
 }
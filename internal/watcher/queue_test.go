@@ -0,0 +1,442 @@
+package watcher
+
+import (
+	"context"
+	"gosync/conf"
+	"gosync/internal/dest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t *testing.T, workers int) (*Queue, *dest.Fake) {
+	t.Helper()
+	fake := dest.NewFake("data", &conf.RsyncConfig{Name: "data", RootPath: t.TempDir() + "/", AllowDelete: true})
+	// 重试间隔足够长，由测试调用RetryNow触发重试
+	c := &conf.QueueConfig{RetryInterval: "1h", Capacity: 1000, Workers: workers, DrainTimeout: "5s"}
+	queue, err := CreateQueue(c, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { queue.Close() })
+	return queue, fake
+}
+
+// 在后台消费队列，返回的函数停止队列并等待消费协程退出
+func runQueue(queue *Queue) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		queue.Start(ctx)
+	}()
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// 等待远端收到n次调用并返回这些调用
+func waitCalls(t *testing.T, fake *dest.Fake, n int) []dest.Call {
+	t.Helper()
+	calls := []dest.Call{}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(calls) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d calls, want %d: %v", len(calls), n, calls)
+		}
+		time.Sleep(10 * time.Millisecond)
+		calls = append(calls, fake.Calls()...)
+	}
+	return calls
+}
+
+func callStr(call dest.Call) string {
+	if call.Op == "rename" {
+		return "rename " + call.From + " -> " + call.Paths[0]
+	}
+	return call.Op + " " + strings.Join(call.Paths, ",")
+}
+
+func actionStrs(actions []Action) []string {
+	list := []string{}
+	for _, action := range actions {
+		list = append(list, action.String())
+	}
+	return list
+}
+
+// 同一路径的连续变更合并为一个任务，目录的任务覆盖其下的路径
+func TestOfferCoalesces(t *testing.T) {
+	type op struct {
+		method int
+		path   string
+		from   string
+	}
+	tests := []struct {
+		name string
+		ops  []op
+		want []string
+	}{
+		{"repeated write", []op{{WRITE, "a", ""}, {WRITE, "a", ""}}, []string{"WRITE a"}},
+		{"write under created dir", []op{{CREATE, "dir/", ""}, {WRITE, "dir/a", ""}, {CREATE, "dir/sub/", ""}}, []string{"CREATE dir/"}},
+		{"dir created after write", []op{{WRITE, "dir/a", ""}, {ATTRIB, "dir/b", ""}, {CREATE, "dir/", ""}}, []string{"CREATE dir/"}},
+		{"delete after write", []op{{WRITE, "a", ""}, {DELETE, "a", ""}}, []string{"DELETE a"}},
+		{"write after delete", []op{{DELETE, "a", ""}, {WRITE, "a", ""}}, []string{"WRITE a"}},
+		{"delete under deleted dir", []op{{DELETE, "dir/", ""}, {DELETE, "dir/a", ""}}, []string{"DELETE dir/"}},
+		{"dir deleted after children", []op{{WRITE, "dir/a", ""}, {DELETE, "dir/b", ""}, {DELETE, "dir/", ""}}, []string{"DELETE dir/"}},
+		{"attrib after write", []op{{WRITE, "a", ""}, {ATTRIB, "a", ""}}, []string{"WRITE a"}},
+		{"write after attrib", []op{{ATTRIB, "a", ""}, {WRITE, "a", ""}}, []string{"WRITE a"}},
+		{"other paths kept", []op{{WRITE, "a", ""}, {WRITE, "ab", ""}, {DELETE, "dir", ""}, {WRITE, "dir2/a", ""}}, []string{"WRITE a", "WRITE ab", "DELETE dir", "WRITE dir2/a"}},
+		{"rename drops writes to new path", []op{{WRITE, "b", ""}, {WRITE, "c", ""}, {RENAME, "b", "a"}}, []string{"WRITE c", "RENAME a -> b"}},
+		{"rename dir drops writes under it", []op{{CREATE, "new/", ""}, {WRITE, "new/x", ""}, {RENAME, "new/", "old/"}}, []string{"RENAME old/ -> new/"}},
+		{"rename kept", []op{{RENAME, "b", "a"}, {WRITE, "b", ""}, {DELETE, "b", ""}, {DELETE, "a", ""}}, []string{"RENAME a -> b", "DELETE b", "DELETE a"}},
+		{"delete kept before rename", []op{{DELETE, "a", ""}, {RENAME, "a", "x"}}, []string{"DELETE a", "RENAME x -> a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue, _ := newTestQueue(t, 1)
+			for _, op := range test.ops {
+				if op.method == RENAME {
+					queue.offerRename(op.from, op.path)
+				} else {
+					queue.offer(op.method, op.path)
+				}
+			}
+			if got := actionStrs(queue.actions); strings.Join(got, "; ") != strings.Join(test.want, "; ") {
+				t.Errorf("actions = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// 被合并的任务的变更时间延续到新的任务
+func TestOfferKeepsEarliestSince(t *testing.T) {
+	queue, _ := newTestQueue(t, 1)
+	queue.offer(WRITE, "dir/a")
+	since := queue.actions[0].Since
+	time.Sleep(5 * time.Millisecond)
+	queue.offer(DELETE, "dir/")
+	time.Sleep(5 * time.Millisecond)
+	queue.offerRename("dir/", "new/")
+	if len(queue.actions) != 2 || queue.actions[0].Since != since {
+		t.Errorf("actions = %+v, want since %d", queue.actions, since)
+	}
+	if queue.actions[1].Since <= since {
+		t.Errorf("rename since %d should not inherit from delete", queue.actions[1].Since)
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"a", "a", true},
+		{"dir/", "dir", true},
+		{"dir/", "dir/a", true},
+		{"dir/a/b", "dir/", true},
+		{"dir", "dir2", false},
+		{"dir/a", "dir/b", false},
+	}
+	for _, test := range tests {
+		if got := overlaps(test.a, test.b); got != test.want {
+			t.Errorf("overlaps(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+	rename := Action{Method: RENAME, From: "old/", Path: "new/"}
+	if !related(rename, Action{Method: WRITE, Path: "old/a"}) || !related(Action{Method: DELETE, Path: "old"}, rename) {
+		t.Error("rename should be related to its source path")
+	}
+	if !related(rename, Action{Method: RENAME, From: "old/a", Path: "x"}) {
+		t.Error("renames with related sources should be related")
+	}
+	if related(rename, Action{Method: WRITE, Path: "other"}) {
+		t.Error("rename should not be related to other paths")
+	}
+}
+
+// 相关路径上的动作按入队顺序执行，相关的同类动作合并到同一批
+func TestSchedule(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions []Action
+		running []Action
+		workers int
+		batches []string
+		rest    []string
+	}{
+		{
+			name:    "independent writes",
+			actions: []Action{{Method: WRITE, Path: "a"}, {Method: WRITE, Path: "b"}, {Method: WRITE, Path: "c"}},
+			workers: 2,
+			batches: []string{"WRITE a, WRITE c", "WRITE b"},
+		},
+		{
+			name:    "related writes in one batch",
+			actions: []Action{{Method: CREATE, Path: "dir/", IsDir: true}, {Method: WRITE, Path: "x"}, {Method: WRITE, Path: "dir/a"}},
+			workers: 2,
+			batches: []string{"CREATE dir/, WRITE dir/a", "WRITE x"},
+		},
+		{
+			name:    "delete waits for write",
+			actions: []Action{{Method: WRITE, Path: "dir/a"}, {Method: DELETE, Path: "dir/", IsDir: true}, {Method: DELETE, Path: "b"}},
+			workers: 2,
+			batches: []string{"WRITE dir/a", "DELETE b"},
+			rest:    []string{"DELETE dir/"},
+		},
+		{
+			name:    "blocked action blocks later ones",
+			actions: []Action{{Method: WRITE, Path: "a"}, {Method: DELETE, Path: "a"}, {Method: WRITE, Path: "a"}},
+			workers: 3,
+			batches: []string{"WRITE a"},
+			rest:    []string{"DELETE a", "WRITE a"},
+		},
+		{
+			name:    "running action blocks",
+			actions: []Action{{Method: WRITE, Path: "dir/a"}, {Method: WRITE, Path: "b"}},
+			running: []Action{{Method: WRITE, Path: "dir/", IsDir: true}},
+			workers: 2,
+			batches: []string{"WRITE b"},
+			rest:    []string{"WRITE dir/a"},
+		},
+		{
+			name:    "rename blocks source path",
+			actions: []Action{{Method: RENAME, From: "old", Path: "new"}, {Method: WRITE, Path: "old"}, {Method: WRITE, Path: "new"}},
+			workers: 3,
+			batches: []string{"RENAME old -> new"},
+			rest:    []string{"WRITE old", "WRITE new"},
+		},
+		{
+			name:    "parent of two groups",
+			actions: []Action{{Method: WRITE, Path: "dir/a"}, {Method: WRITE, Path: "dir/b"}, {Method: CREATE, Path: "dir/", IsDir: true}},
+			workers: 3,
+			batches: []string{"WRITE dir/a", "WRITE dir/b"},
+			rest:    []string{"CREATE dir/"},
+		},
+		{
+			name:    "different kinds beyond workers",
+			actions: []Action{{Method: WRITE, Path: "a"}, {Method: DELETE, Path: "b"}, {Method: WRITE, Path: "c"}},
+			workers: 1,
+			batches: []string{"WRITE a, WRITE c"},
+			rest:    []string{"DELETE b"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := range test.actions {
+				test.actions[i].id = uint64(i + 1)
+			}
+			batches, rest := schedule(test.actions, test.running, test.workers)
+			got := []string{}
+			for _, batch := range batches {
+				got = append(got, strings.Join(actionStrs(batch), ", "))
+			}
+			if strings.Join(got, "; ") != strings.Join(test.batches, "; ") {
+				t.Errorf("batches = %v, want %v", got, test.batches)
+			}
+			if strings.Join(actionStrs(rest), "; ") != strings.Join(test.rest, "; ") {
+				t.Errorf("rest = %v, want %v", actionStrs(rest), test.rest)
+			}
+		})
+	}
+}
+
+// 部分路径失败时只重试失败的路径
+func TestPartialFailureRetriesFailedPaths(t *testing.T) {
+	queue, fake := newTestQueue(t, 1)
+	fake.FailPath("b", 1)
+	stop := runQueue(queue)
+	defer stop()
+	queue.offer(WRITE, "a")
+	queue.offer(WRITE, "b")
+	queue.offer(WRITE, "c")
+	calls := waitCalls(t, fake, 1)
+	if callStr(calls[0]) != "sync a,b,c" {
+		t.Fatalf("first call = %s", callStr(calls[0]))
+	}
+	// 重试前的新变更按入队顺序与失败的任务合并
+	queue.offer(WRITE, "d")
+	queue.offer(WRITE, "a")
+	time.Sleep(2 * settleTime)
+	queue.RetryNow()
+	calls = waitCalls(t, fake, 1)
+	if callStr(calls[0]) != "sync b,d,a" {
+		t.Errorf("retry call = %s, want sync b,d,a", callStr(calls[0]))
+	}
+	stop()
+	if remaining := queue.Wait(); remaining != 0 {
+		t.Errorf("%d tasks remaining", remaining)
+	}
+}
+
+// 远端不可用时整批任务都要重试
+func TestFatalErrorRetriesWholeBatch(t *testing.T) {
+	queue, fake := newTestQueue(t, 1)
+	fake.SetUnavailable(true)
+	stop := runQueue(queue)
+	defer stop()
+	queue.offer(WRITE, "a")
+	queue.offer(WRITE, "b")
+	queue.offer(WRITE, "c")
+	calls := waitCalls(t, fake, 1)
+	if callStr(calls[0]) != "sync a,b,c" {
+		t.Fatalf("first call = %s", callStr(calls[0]))
+	}
+	// 重试等待期间不会再次调用
+	time.Sleep(2 * settleTime)
+	if calls := fake.Calls(); len(calls) != 0 {
+		t.Fatalf("unexpected calls while waiting to retry: %v", calls)
+	}
+	fake.SetUnavailable(false)
+	queue.RetryNow()
+	calls = waitCalls(t, fake, 1)
+	if callStr(calls[0]) != "sync a,b,c" {
+		t.Errorf("retry call = %s, want sync a,b,c", callStr(calls[0]))
+	}
+	stop()
+	if remaining := queue.Wait(); remaining != 0 {
+		t.Errorf("%d tasks remaining", remaining)
+	}
+}
+
+// 等待队列中没有等待、执行中的任务和全量同步
+func waitIdle(t *testing.T, queue *Queue) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for idle := 0; idle < 3; {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue not idle: %+v", queue.Status())
+		}
+		time.Sleep(settleTime)
+		status := queue.Status()
+		if status.OldestUnsynced.IsZero() && len(status.Inflight) == 0 && !status.FullSyncPending && !status.FullSyncRunning {
+			idle++
+		} else {
+			idle = 0
+		}
+	}
+}
+
+// 暂停期间变更仍进入队列但不执行，恢复后等待中的全量同步覆盖这些变更
+func TestPauseHoldsTasks(t *testing.T) {
+	queue, fake := newTestQueue(t, 2)
+	stop := runQueue(queue)
+	defer stop()
+	queue.Pause()
+	queue.offer(WRITE, "a")
+	time.Sleep(3 * settleTime)
+	if status := queue.Status(); !status.Paused || status.Queued != 1 {
+		t.Fatalf("status = %+v", status)
+	}
+	// 暂停期间等待中的全量同步也会覆盖队列中的变更
+	queue.ScheduleFullSync()
+	time.Sleep(settleTime)
+	if calls := fake.Calls(); len(calls) != 0 {
+		t.Fatalf("calls while paused: %v", calls)
+	}
+	if status := queue.Status(); status.Queued != 0 || !status.FullSyncPending || status.OldestUnsynced.IsZero() {
+		t.Fatalf("status = %+v", status)
+	}
+	queue.Resume()
+	waitIdle(t, queue)
+	calls := fake.Calls()
+	if len(calls) != 1 || callStr(calls[0]) != "full " {
+		t.Errorf("calls = %v, want a full sync only", calls)
+	}
+}
+
+// 全量同步等待执行中的任务完成，之后的变更被全量同步覆盖
+func TestFullSyncWaitsForRunningTasks(t *testing.T) {
+	queue, fake := newTestQueue(t, 2)
+	fake.SetDelay(3 * settleTime)
+	stop := runQueue(queue)
+	defer stop()
+	queue.offer(WRITE, "a")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(queue.Status().Inflight) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("task not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	queue.ScheduleFullSync()
+	queue.offer(WRITE, "b")
+	calls := waitCalls(t, fake, 2)
+	if callStr(calls[0]) != "sync a" || callStr(calls[1]) != "full " {
+		t.Errorf("calls = %v", calls)
+	}
+	waitIdle(t, queue)
+	if calls := fake.Calls(); len(calls) != 0 {
+		t.Errorf("unexpected calls after full sync: %v", calls)
+	}
+}
+
+// 多个协程同时提交变更、请求全量同步、暂停和恢复队列，需要在-race下运行。
+// 结束后队列排空，请求的全量同步已经执行。
+func TestQueueConcurrentAccess(t *testing.T) {
+	queue, fake := newTestQueue(t, 4)
+	fake.SetDelay(time.Millisecond)
+	stop := runQueue(queue)
+	defer stop()
+
+	const writers, changes = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < changes; i++ {
+				path := "dir" + string(rune('a'+w)) + "/f" + string(rune('a'+i%26))
+				switch i % 5 {
+				case 3:
+					queue.offer(DELETE, path)
+				case 4:
+					queue.offerRename(path, path+"-renamed")
+				default:
+					queue.offer(WRITE, path)
+				}
+				if i%10 == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}(w)
+	}
+	controls := make(chan struct{})
+	go func() {
+		defer close(controls)
+		for i := 0; i < 20; i++ {
+			switch i % 4 {
+			case 0:
+				queue.Pause()
+			case 1:
+				queue.Resume()
+			case 2:
+				queue.ScheduleFullSync()
+			case 3:
+				queue.RetryNow()
+			}
+			queue.Status()
+			queue.List()
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	wg.Wait()
+	<-controls
+	queue.Resume()
+	waitIdle(t, queue)
+
+	full := false
+	for _, call := range fake.Calls() {
+		full = full || call.Op == "full"
+	}
+	if !full {
+		t.Error("scheduled full sync not performed")
+	}
+	stop()
+	if remaining := queue.Wait(); remaining != 0 {
+		t.Errorf("%d tasks remaining", remaining)
+	}
+}
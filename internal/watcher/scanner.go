@@ -0,0 +1,131 @@
+package watcher
+
+import (
+	"context"
+	"gosync/conf"
+	"gosync/internal/rsync"
+	"gosync/internal/tree"
+	"io/fs"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 文件在快照中的状态
+type fileState struct {
+	IsDir bool
+	Size  int64
+	Mtime int64
+	Inode uint64
+}
+
+// 定时扫描目录并与上次的快照比较，用于NFS、CIFS等收不到inotify事件的文件系统
+func watchPoll(ctx context.Context, config *conf.RsyncConfig, workdir string, watchDir string, queues []*Queue) error {
+	interval, _ := time.ParseDuration(config.ScanInterval)
+	snapshot, err := scan(config, workdir, watchDir)
+	if err != nil {
+		logrus.WithError(err).Errorf("Watch %s failed.", watchDir)
+		return err
+	}
+	logrus.Infof("Watch %s started. (poll every %s, %d paths)", watchDir, interval, len(snapshot))
+	startQueues(ctx, config, queues)
+
+	for {
+		select {
+		case <-ctx.Done():
+			logrus.Infof("Watch %s stopped.", watchDir)
+			return nil
+		case <-time.After(interval):
+		}
+		config = current(config)
+		interval, _ = time.ParseDuration(config.ScanInterval)
+		latest, err := scan(config, workdir, watchDir)
+		if err != nil {
+			logrus.WithError(err).Errorf("Scan %s failed.", watchDir)
+			continue
+		}
+		diff(config, queues, snapshot, latest)
+		syncJournals(queues)
+		snapshot = latest
+	}
+}
+
+// 扫描监听范围内的所有路径，目录以/结尾
+func scan(config *conf.RsyncConfig, workdir string, watchDir string) (map[string]fileState, error) {
+	includes, err := rsync.GetWatchFolders(config, workdir)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := map[string]fileState{}
+	err = walkTree(config, includes, watchDir, "", func(path string, state fileState) {
+		snapshot[path] = state
+	})
+	return snapshot, err
+}
+
+// 遍历dir(相对路径，空表示根目录)及其下在监听范围内的路径，目录以/结尾。
+// 同一目录下按名称顺序遍历，目录先于其子路径，与manifestCompare的顺序一致。
+func walkTree(config *conf.RsyncConfig, includes []string, watchDir string, dir string, fn func(path string, state fileState)) error {
+	return tree.Walk(watchDir, dir, config.Symlinks, func(path string, info fs.FileInfo, err error) (bool, error) {
+		if err != nil {
+			// 扫描过程中被删除的路径忽略即可
+			logrus.Debugf("Scan %s error: %s", path, err.Error())
+			return false, nil
+		}
+		if path == "" {
+			return true, nil
+		}
+		if tree.Excluded(config.Excludes, path) || !tree.ShouldWatch(includes, path) {
+			return false, nil
+		}
+		fn(path, statOf(info))
+		return true, nil
+	})
+}
+
+func statOf(info fs.FileInfo) fileState {
+	state := fileState{IsDir: info.IsDir()}
+	if !state.IsDir {
+		state.Size = info.Size()
+		state.Mtime = info.ModTime().UnixNano()
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		state.Inode = stat.Ino
+	}
+	return state
+}
+
+// 比较两次快照，将差异转换为同步任务
+func diff(config *conf.RsyncConfig, queues []*Queue, before map[string]fileState, after map[string]fileState) {
+	deleted := []string{}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			deleted = append(deleted, path)
+		}
+	}
+	// 先处理上级目录，子路径的删除会被合并
+	sort.Strings(deleted)
+	if config.AllowDelete {
+		for _, path := range deleted {
+			offer(queues, DELETE, path)
+		}
+	}
+
+	changed := []string{}
+	for path, state := range after {
+		old, ok := before[path]
+		if !ok || (!state.IsDir && state != old) {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	for _, path := range changed {
+		if after[path].IsDir {
+			offer(queues, CREATE, path)
+		} else {
+			offer(queues, WRITE, path)
+		}
+	}
+}
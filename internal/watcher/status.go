@@ -0,0 +1,178 @@
+package watcher
+
+import (
+	"cmp"
+	"gosync/internal/dest"
+	"gosync/internal/metrics"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 消费协程的运行状态，执行全量同步时消费协程会长时间阻塞，因此由消费协程主动发布，而不是由查询方请求
+type loopState struct {
+	pending         []Action
+	inflight        []Action
+	retryAt         time.Time
+	fullSyncRunning bool
+	lastSuccess     time.Time
+	lastFailure     time.Time
+	lastError       string
+	sentFiles       int64
+	sentBytes       int64
+	deletedFiles    int64
+}
+
+// 队列的运行状态
+type QueueStatus struct {
+	Name            string    `json:"name"`
+	Queued          int       `json:"queued"`
+	Inflight        []string  `json:"inflight"`
+	FullSyncPending bool      `json:"full-sync-pending"`
+	FullSyncRunning bool      `json:"full-sync-running"`
+	Paused          bool      `json:"paused"`
+	RetryAt         time.Time `json:"retry-at"`
+	OldestUnsynced  time.Time `json:"oldest-unsynced"`
+	LastSuccess     time.Time `json:"last-success"`
+	LastFailure     time.Time `json:"last-failure"`
+	LastError       string    `json:"last-error,omitempty"`
+	SentFiles       int64     `json:"sent-files"`
+	SentBytes       int64     `json:"sent-bytes"`
+	DeletedFiles    int64     `json:"deleted-files"`
+}
+
+func (queue *Queue) Name() string {
+	return queue.name
+}
+
+func (queue *Queue) Status() QueueStatus {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	status := QueueStatus{
+		Name:            queue.name,
+		Queued:          len(queue.state.pending) + len(queue.actions),
+		Inflight:        []string{},
+		FullSyncPending: queue.fullSync,
+		FullSyncRunning: queue.state.fullSyncRunning,
+		Paused:          queue.paused,
+		RetryAt:         queue.state.retryAt,
+		OldestUnsynced:  queue.oldestUnsynced(),
+		LastSuccess:     queue.state.lastSuccess,
+		LastFailure:     queue.state.lastFailure,
+		LastError:       queue.state.lastError,
+		SentFiles:       queue.state.sentFiles,
+		SentBytes:       queue.state.sentBytes,
+		DeletedFiles:    queue.state.deletedFiles,
+	}
+	for _, action := range queue.state.inflight {
+		status.Inflight = append(status.Inflight, action.String())
+	}
+	return status
+}
+
+// 等待同步的任务，按同步顺序排列
+func (queue *Queue) List() []string {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	list := []string{}
+	for _, action := range queue.state.pending {
+		list = append(list, action.String())
+	}
+	for _, action := range queue.actions {
+		list = append(list, action.String())
+	}
+	return list
+}
+
+// 暂停后不再执行新的同步任务和全量同步，执行中的任务不受影响，变更仍会进入队列
+func (queue *Queue) Pause() {
+	queue.mu.Lock()
+	queue.paused = true
+	queue.mu.Unlock()
+	logrus.Infof("Sync queue of %s paused.", queue.name)
+	queue.notify()
+}
+
+func (queue *Queue) Resume() {
+	queue.mu.Lock()
+	queue.paused = false
+	queue.mu.Unlock()
+	logrus.Infof("Sync queue of %s resumed.", queue.name)
+	queue.notify()
+}
+
+// 跳过当前的重试等待，立即重试失败的任务
+func (queue *Queue) RetryNow() {
+	queue.mu.Lock()
+	queue.retryNow = true
+	queue.mu.Unlock()
+	logrus.Infof("Retry sync queue of %s now.", queue.name)
+	queue.notify()
+}
+
+// 读取暂停状态和立即重试的请求，立即重试的请求读取后清除
+func (queue *Queue) controls() (bool, bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	retryNow := queue.retryNow
+	queue.retryNow = false
+	return queue.paused, retryNow
+}
+
+// 发布消费协程持有的任务，actions在消费协程中会被继续修改，需要复制
+func (queue *Queue) publish(actions []Action, running map[int][]Action, retryAt time.Time, fullSyncRunning bool) {
+	inflight := []Action{}
+	for _, batch := range running {
+		inflight = append(inflight, batch...)
+	}
+	slices.SortFunc(inflight, func(a, b Action) int {
+		return cmp.Compare(a.id, b.id)
+	})
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.state.pending = slices.Clone(actions)
+	queue.state.inflight = inflight
+	queue.state.retryAt = retryAt
+	queue.state.fullSyncRunning = fullSyncRunning
+	queue.updateDepth()
+}
+
+// 更新队列长度的指标，需要持有mu
+func (queue *Queue) updateDepth() {
+	metrics.QueueDepth.Set(float64(len(queue.state.pending)+len(queue.actions)), queue.name)
+}
+
+// 记录最近一次成功或失败的时间
+func (queue *Queue) finished(ok bool, message string) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if ok {
+		queue.state.lastSuccess = time.Now()
+	} else {
+		queue.state.lastFailure = time.Now()
+		queue.state.lastError = message
+	}
+}
+
+// 远端报告的单个文件的同步结果，逐个记录到日志作为审计记录，并累计发送的文件数、字节数和删除的文件数
+func (queue *Queue) transferred(result dest.FileResult) {
+	if result.Err != nil {
+		return
+	}
+	if result.Deleted() {
+		logrus.Infof("Deleted %s from %s.", result.Path, queue.name)
+	} else if result.Change == "" {
+		logrus.Infof("Synced %s to %s. (%d bytes sent)", result.Path, queue.name, result.Sent)
+	} else {
+		logrus.Infof("Synced %s to %s. (%s, %d bytes sent)", result.Path, queue.name, result.Change, result.Sent)
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if result.Deleted() {
+		queue.state.deletedFiles++
+	} else if result.Transferred() {
+		queue.state.sentFiles++
+		queue.state.sentBytes += result.Sent
+	}
+}
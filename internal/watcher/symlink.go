@@ -0,0 +1,59 @@
+package watcher
+
+import (
+	"gosync/conf"
+	"gosync/internal/tree"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 按符号链接策略获取路径的状态
+func statPath(config *conf.RsyncConfig, path string) (fs.FileInfo, error) {
+	if config.Symlinks == "follow" {
+		return os.Stat(config.RootPath + path)
+	}
+	return os.Lstat(config.RootPath + path)
+}
+
+// 新建的符号链接不会产生写入完成的事件，需要在新建时按策略处理。
+// watches为空时(fanotify)无需添加监听。
+func offerSymlink(config *conf.RsyncConfig, workdir string, watches *watchTable, queues []*Queue, path string) {
+	info, err := os.Lstat(config.RootPath + path)
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 || config.Symlinks == "skip" {
+		return
+	}
+	if config.Symlinks == "follow" {
+		info, err = os.Stat(config.RootPath + path)
+		if err != nil {
+			logrus.Debugf("Ignore dangling symlink: %s", path)
+			return
+		}
+		if info.IsDir() {
+			// 指向上级目录的链接会形成环
+			target, _ := filepath.EvalSymlinks(config.RootPath + path)
+			parent, _ := filepath.EvalSymlinks(filepath.Dir(config.RootPath + path))
+			if strings.HasPrefix(parent+"/", target+"/") {
+				logrus.Warnf("Skip symlink loop: %s", path)
+				return
+			}
+			dir := path + "/"
+			ok := false
+			if watches != nil {
+				ok = watchFolder(config, workdir, watches, dir)
+			} else {
+				_, ok = inScope(config, workdir, dir)
+			}
+			if ok {
+				offer(queues, CREATE, dir)
+			}
+			return
+		}
+	}
+	if !tree.Excluded(config.Excludes, path) {
+		offer(queues, WRITE, path)
+	}
+}
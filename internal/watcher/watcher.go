@@ -1,24 +1,148 @@
 package watcher
 
 import (
+	"context"
+	"fmt"
 	"gosync/conf"
+	"gosync/internal/metrics"
 	"gosync/internal/rsync"
-	"os"
+	"gosync/internal/tree"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
-	"github.com/bmatcuk/doublestar/v4"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
 
-func Start(config *conf.RsyncConfig, queue *Queue) error {
+// 内核事件队列溢出和读取事件失败的次数
+var (
+	overflows  atomic.Uint64
+	readErrors atomic.Uint64
+)
+
+func Overflows() uint64 {
+	return overflows.Load()
+}
+
+func ReadErrors() uint64 {
+	return readErrors.Load()
+}
+
+// 连续读取事件失败的次数超过该值后停止监听，交由进程的守护程序处理
+const maxReadFailures = 5
+
+// 连续读取失败时第一次重试的等待时间，之后每次加倍
+var readRetryDelay = time.Second
+
+// 读取事件失败后的重试状态
+type readRetry struct {
+	failures int
+}
+
+// 记录一次读取失败并等待重试，连续失败超过maxReadFailures次时返回错误
+func (retry *readRetry) failed(ctx context.Context, config *conf.RsyncConfig, watchDir string, queues []*Queue, err error) error {
+	readErrors.Add(1)
+	metrics.WatchReadErrors.Inc(config.Name)
+	retry.failures++
+	if retry.failures > maxReadFailures {
+		logrus.WithError(err).Errorf("Read events of %s failed %d times, stop watching.", watchDir, retry.failures)
+		return fmt.Errorf("read events of %s: %w", watchDir, err)
+	}
+	delay := readRetryDelay << (retry.failures - 1)
+	if retry.failures == 1 {
+		// 无法确定丢失了哪些事件，通过全量同步恢复，连续的失败只需要一次
+		logrus.WithError(err).Errorf("Read events of %s failed, a full sync will be performed to recover.", watchDir)
+		scheduleFullSync(queues)
+	} else {
+		logrus.WithError(err).Errorf("Read events of %s failed, retry in %s.", watchDir, delay)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(delay):
+	}
+	return nil
+}
+
+func (retry *readRetry) succeeded() {
+	retry.failures = 0
+}
+
+// 创建一个在ctx取消后变为可读的管道，与inotify、fanotify的fd一起poll，用于结束阻塞的读取
+func stopNotifier(ctx context.Context) (int, func(), error) {
+	var fds [2]int
+	err := unix.Pipe2(fds[:], unix.O_CLOEXEC)
+	if err != nil {
+		return -1, nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		unix.Write(fds[1], []byte{0})
+	})
+	return fds[0], func() {
+		stop()
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+	}, nil
+}
+
+// 重新加载后的同步目标配置，按名称索引
+var configs sync.Map
+
+// 替换同步目标的配置，监听协程处理下一批事件时生效。root-path等监听相关的配置需要重启才能生效。
+func Reload(config *conf.RsyncConfig) {
+	configs.Store(config.Name, config)
+}
+
+// 同步目标的最新配置
+func current(config *conf.RsyncConfig) *conf.RsyncConfig {
+	if c, ok := configs.Load(config.Name); ok {
+		return c.(*conf.RsyncConfig)
+	}
+	return config
+}
+
+// 监听同步目标的根目录，变更会分发到每个远端各自的同步队列。ctx取消后停止监听并返回nil，
+// 队列在排空后停止，可以通过Queue.Wait等待。
+func Start(ctx context.Context, config *conf.RsyncConfig, workdir string, queues []*Queue) error {
 	watchDir := config.RootPath
 	if !strings.HasSuffix(watchDir, "/") {
 		watchDir += "/"
 	}
+	switch config.Watcher {
+	case "fanotify":
+		return watchFanotify(ctx, config, workdir, watchDir, queues)
+	case "poll":
+		return watchPoll(ctx, config, workdir, watchDir, queues)
+	default:
+		return watchInotify(ctx, config, workdir, watchDir, queues)
+	}
+}
+
+// 开启同步任务，每个远端的队列独立重试和全量同步
+func startQueues(ctx context.Context, config *conf.RsyncConfig, queues []*Queue) {
+	for _, queue := range queues {
+		queue.done = make(chan struct{})
+		go func(queue *Queue) {
+			defer close(queue.done)
+			queue.Start(ctx)
+		}(queue)
+		if config.FullSync == "startup" && !queue.Restored() {
+			queue.ScheduleFullSync()
+		} else if config.FullSync == "reconcile" {
+			// 监听已经开始，比较期间发生的变更不会遗漏
+			go func(queue *Queue) {
+				if !queue.Reconcile() {
+					queue.ScheduleFullSync()
+				}
+			}(queue)
+		}
+	}
+}
 
+func watchInotify(ctx context.Context, config *conf.RsyncConfig, workdir string, watchDir string, queues []*Queue) error {
 	// 初始化 inotify
 	fd, err := unix.InotifyInit()
 	if err != nil {
@@ -28,40 +152,93 @@ func Start(config *conf.RsyncConfig, queue *Queue) error {
 	defer unix.Close(fd)
 
 	// 创建一个映射表，将 watch descriptor (wd) 映射到目录路径
-	wdToPath := make(map[int]string)
+	watches := newWatchTable(fd, config.Name, watchDir, config.Symlinks)
 
 	// 添加根目录及其子目录到监听
-	includes, err := rsync.GetWatchFolders()
+	includes, err := rsync.GetWatchFolders(config, workdir)
 	if err != nil {
 		logrus.WithError(err).Error("Eval watch scope error")
 		return err
 	}
-	err = addWatchRecursive(fd, watchDir, &includes, &config.Excludes, "", wdToPath)
+	err = watches.add(includes, config.Excludes, "")
 	if err != nil {
 		logrus.WithError(err).Errorf("Watch %s failed.", watchDir)
 		return err
 	}
 	logrus.Infof("Watch %s started.", watchDir)
+	startQueues(ctx, config, queues)
 
-	// 开启同步任务
-	go queue.Start()
-	if config.FullSync == "startup" {
-		queue.ScheduleFullSync()
+	stopFd, closeStopFd, err := stopNotifier(ctx)
+	if err != nil {
+		return err
 	}
+	defer closeStopFd()
 
-	// 创建用于接收事件的缓冲区
-	buf := make([]byte, 4096)
+	// 创建用于接收事件的缓冲区，较大的缓冲区可以一次读取更多事件，降低内核队列溢出的可能
+	buf := make([]byte, 64*1024)
+
+	// 等待配对的IN_MOVED_FROM事件，按cookie索引。
+	// 配对的IN_MOVED_TO事件总是紧跟在IN_MOVED_FROM之后，没有配对的说明文件被移出了监听目录，按删除处理。
+	moves := map[uint32]move{}
+	retry := readRetry{}
+	flushMoves := func(keep uint32) {
+		var includes []string
+		evaluated := false
+		for cookie, m := range moves {
+			if cookie != keep {
+				if !evaluated {
+					includes, evaluated = moveScope(config, workdir), true
+				}
+				delete(moves, cookie)
+				if m.isDir {
+					watches.remove(m.path)
+				}
+				offerMove(config, includes, queues, m.path, "")
+			}
+		}
+	}
 
 	for {
+		// 最后一个事件是IN_MOVED_FROM时，等待一小段时间看是否有配对的事件
+		timeout := -1
+		if len(moves) > 0 {
+			timeout = 10
+		}
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}, {Fd: int32(stopFd), Events: unix.POLLIN}}
+		ready, err := unix.Poll(fds, timeout)
+		if fds[1].Revents != 0 {
+			flushMoves(0)
+			logrus.Infof("Watch %s stopped.", watchDir)
+			return nil
+		}
+		if ready == 0 && err == nil {
+			flushMoves(0)
+			syncJournals(queues)
+			continue
+		}
+		if fds[0].Revents == 0 {
+			continue
+		}
+
 		// 读取 inotify 事件
 		n, err := unix.Read(fd, buf)
 		if err != nil {
-			logrus.WithError(err).Error("Read inotify event failed.")
+			if err == unix.EINTR {
+				continue
+			}
+			if err := retry.failed(ctx, config, watchDir, queues, err); err != nil {
+				flushMoves(0)
+				return err
+			}
+			continue
 		}
+		retry.succeeded()
 
-		// 解析事件
+		// 解析事件，使用重新加载后的排除规则等配置
+		config = current(config)
 		var offset uint32
-		for offset <= uint32(n-16) {
+		var lastMove uint32
+		for n >= unix.SizeofInotifyEvent && offset <= uint32(n-unix.SizeofInotifyEvent) {
 			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
 			nameLen := uint32(raw.Len)
 			name := ""
@@ -69,8 +246,26 @@ func Start(config *conf.RsyncConfig, queue *Queue) error {
 				name = strings.TrimRight(string(buf[offset+16:offset+16+nameLen-1]), "\x00")
 			}
 
-			// 从 wdToPath 映射表中获取事件目录的相对路径
-			basePath, ok := wdToPath[int(raw.Wd)]
+			offset += 16 + nameLen
+			lastMove = 0
+
+			// 内核事件队列溢出，事件已经丢失，通过全量同步恢复
+			if raw.Mask&unix.IN_Q_OVERFLOW == unix.IN_Q_OVERFLOW {
+				overflows.Add(1)
+				metrics.WatchOverflows.Inc(config.Name)
+				logrus.Errorf("Inotify event queue of %s overflowed, a full sync will be performed to recover.", watchDir)
+				scheduleFullSync(queues)
+				continue
+			}
+
+			// 目录被删除或移除监听后，清理映射表
+			if raw.Mask&unix.IN_IGNORED == unix.IN_IGNORED {
+				watches.forget(int(raw.Wd))
+				continue
+			}
+
+			// 从映射表中获取事件目录的相对路径
+			basePath, ok := watches.path(int(raw.Wd))
 			if !ok {
 				logrus.Warnf("Path not found for wd: %d", raw.Wd)
 				continue
@@ -87,100 +282,130 @@ func Start(config *conf.RsyncConfig, queue *Queue) error {
 			switch {
 			case raw.Mask&unix.IN_CREATE == unix.IN_CREATE:
 				// 如果创建的是目录，则递归监听该目录
-				if isDir {
-					if !isExclude(&config.Excludes, eventPath) {
-						includes, err := rsync.GetWatchFolders()
-						if err != nil {
-							logrus.WithError(err).Error("Eval watch scope error")
-						} else if shouldWatch(&includes, eventPath) {
-							err = addWatchRecursive(fd, watchDir, &includes, &config.Excludes, eventPath, wdToPath)
-							if err != nil {
-								logrus.WithError(err).Errorf("Cannot watch folder: %s", eventPath)
-							}
-							queue.offer(CREATE, eventPath)
-						}
-					}
+				if isDir && watchFolder(config, workdir, watches, eventPath) {
+					offer(queues, CREATE, eventPath)
+				} else if !isDir {
+					offerSymlink(config, workdir, watches, queues, eventPath)
 				}
 			case raw.Mask&unix.IN_CLOSE_WRITE == unix.IN_CLOSE_WRITE:
-				if !isExclude(&config.Excludes, eventPath) {
-					queue.offer(WRITE, eventPath)
+				if !tree.Excluded(config.Excludes, eventPath) {
+					offer(queues, WRITE, eventPath)
 				}
 			case raw.Mask&unix.IN_DELETE == unix.IN_DELETE:
-				if config.AllowDelete && !isExclude(&config.Excludes, eventPath) {
-					queue.offer(DELETE, eventPath)
+				// 删除的符号链接指向的目录不再需要监听
+				if !isDir && watches.watched(eventPath+"/") {
+					watches.remove(eventPath + "/")
 				}
-			case raw.Mask&unix.IN_MOVED_FROM == unix.IN_MOVED_FROM:
-				if config.AllowDelete && !isExclude(&config.Excludes, eventPath) {
-					queue.offer(DELETE, eventPath)
+				if config.AllowDelete && !tree.Excluded(config.Excludes, eventPath) {
+					offer(queues, DELETE, eventPath)
+				}
+			case raw.Mask&unix.IN_ATTRIB == unix.IN_ATTRIB:
+				// 目录自身的属性变化还会通过该目录的wd上报一次，此时没有文件名，由上级目录的事件处理即可
+				if name != "" && !tree.Excluded(config.Excludes, eventPath) {
+					offer(queues, ATTRIB, eventPath)
 				}
+			case raw.Mask&unix.IN_MOVED_FROM == unix.IN_MOVED_FROM:
+				moves[raw.Cookie] = move{path: eventPath, isDir: isDir}
+				lastMove = raw.Cookie
 			case raw.Mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO:
-				if !isExclude(&config.Excludes, eventPath) {
-					queue.offer(CREATE, eventPath)
+				m, paired := moves[raw.Cookie]
+				delete(moves, raw.Cookie)
+				if isDir {
+					// 监听范围内移动的目录更新路径，从外部移入的目录需要递归添加监听
+					if paired && watches.watched(m.path) {
+						watches.move(m.path, eventPath)
+						if _, ok := inScope(config, workdir, eventPath); !ok {
+							watches.remove(eventPath)
+						}
+					} else {
+						watchFolder(config, workdir, watches, eventPath)
+					}
 				}
+				offerMove(config, moveScope(config, workdir), queues, m.path, eventPath)
 			}
-
-			offset += 16 + nameLen
 		}
+		flushMoves(lastMove)
+		syncJournals(queues)
 	}
 }
 
-// 递归添加目录及其子目录到 inotify 监听列表，并记录 wd 到路径的映射
-func addWatchRecursive(fd int, watchDir string, includes *[]string, excludes *[]string, dir string, wdToPath map[int]string) error {
-	return filepath.Walk(watchDir+dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		// 只对目录添加监听
-		if info.IsDir() {
-			relPath, _ := filepath.Rel(watchDir, path)
-			relPath += "/"
-			if shouldWatch(includes, relPath) && !isExclude(excludes, relPath) {
-				wd, err := unix.InotifyAddWatch(fd, path, unix.IN_CREATE|unix.IN_MODIFY|unix.IN_CLOSE_WRITE|unix.IN_DELETE|unix.IN_MOVED_FROM|unix.IN_MOVED_TO)
-				if err != nil {
-					logrus.WithError(err).Errorf("Cannot watch folder: %s", relPath)
-					return err
-				}
-				// 记录 wd 到目录路径的映射
-				wdToPath[wd] = relPath
-				logrus.Debugf("Watch folder: %s (wd: %d)", relPath, wd)
-			}
-		}
+type move struct {
+	path  string
+	isDir bool
+}
+
+// 目录是否在监听范围内
+func inScope(config *conf.RsyncConfig, workdir string, dir string) ([]string, bool) {
+	if tree.Excluded(config.Excludes, dir) {
+		return nil, false
+	}
+	includes, err := rsync.GetWatchFolders(config, workdir)
+	if err != nil {
+		logrus.WithError(err).Error("Eval watch scope error")
+		return nil, false
+	}
+	return includes, tree.ShouldWatch(includes, dir)
+}
+
+// 移动事件使用的监听范围，计算失败时按整个目录处理，避免遗漏移入的路径
+func moveScope(config *conf.RsyncConfig, workdir string) []string {
+	includes, err := rsync.GetWatchFolders(config, workdir)
+	if err != nil {
+		logrus.WithError(err).Error("Eval watch scope error")
 		return nil
-	})
+	}
+	return includes
 }
 
-func isExclude(excludes *[]string, path string) bool {
-	for _, exclude := range *excludes {
-		if !strings.HasPrefix(exclude, "/") {
-			exclude = "/" + exclude
-		}
-		if !strings.HasPrefix(path, "/") {
-			path = "/" + path
-		}
-		if !strings.HasSuffix(exclude, "/") && strings.HasSuffix(path, "/") {
-			path = path[:len(path)-1]
-		}
-		match, err := doublestar.Match(exclude, path)
-		if match && err == nil {
-			return true
-		}
+// 递归监听新出现的目录，返回目录是否在监听范围内
+func watchFolder(config *conf.RsyncConfig, workdir string, watches *watchTable, dir string) bool {
+	includes, ok := inScope(config, workdir, dir)
+	if !ok {
+		return false
 	}
-	return false
+	err := watches.add(includes, config.Excludes, dir)
+	if err != nil {
+		logrus.WithError(err).Errorf("Cannot watch folder: %s", dir)
+	}
+	return true
 }
 
-func shouldWatch(includes *[]string, path string) bool {
-	if includes == nil || path == "." || path == "./" {
-		return true
+// 处理移动事件，原路径和新路径都需要同步时执行重命名，否则按删除或新建处理。
+// 移入或移出监听目录时，对应的一端为空。
+// 不在监听范围内的一端从未同步过，也按移入或移出处理。
+func offerMove(config *conf.RsyncConfig, includes []string, queues []*Queue, from string, to string) {
+	fromSync := from != "" && config.AllowDelete && !tree.Excluded(config.Excludes, from) && tree.ShouldWatch(includes, from)
+	toSync := to != "" && !tree.Excluded(config.Excludes, to) && tree.ShouldWatch(includes, to)
+	if fromSync && toSync {
+		offerRename(queues, from, to)
+	} else if toSync {
+		offer(queues, CREATE, to)
+	} else if fromSync {
+		offer(queues, DELETE, from)
 	}
-	for _, include := range *includes {
-		match, err := doublestar.Match(include+"**", path)
-		if match && err == nil {
-			return true
-		}
-		match, err = doublestar.Match(path+"**", include)
-		if match && err == nil {
-			return true
-		}
+}
+
+func offerRename(queues []*Queue, from string, to string) {
+	for _, queue := range queues {
+		queue.offerRename(from, to)
+	}
+}
+
+func scheduleFullSync(queues []*Queue) {
+	for _, queue := range queues {
+		queue.ScheduleFullSync()
+	}
+}
+
+// 一批事件处理完后将产生的任务同步到变更日志
+func syncJournals(queues []*Queue) {
+	for _, queue := range queues {
+		queue.journal.Sync()
+	}
+}
+
+func offer(queues []*Queue, method int, path string) {
+	for _, queue := range queues {
+		queue.offer(method, path)
 	}
-	return false
 }
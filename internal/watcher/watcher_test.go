@@ -0,0 +1,92 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// 连续读取失败时只执行一次全量同步，超过次数后返回错误，成功读取后重新计数
+func TestReadRetry(t *testing.T) {
+	delay := readRetryDelay
+	readRetryDelay = time.Millisecond
+	defer func() { readRetryDelay = delay }()
+	queue, fake := newTestQueue(t, 1)
+	ctx := context.Background()
+	retry := readRetry{}
+	start := time.Now()
+	for i := 1; i <= maxReadFailures; i++ {
+		if err := retry.failed(ctx, fake.Config(), "/data/", []*Queue{queue}, unix.EBADF); err != nil {
+			t.Fatalf("failure %d: %v", i, err)
+		}
+		if pending, seq := queue.fullSyncPending(); !pending || seq != 1 {
+			t.Fatalf("failure %d: full sync pending %v, seq %d", i, pending, seq)
+		}
+	}
+	// 每次重试的等待时间加倍
+	if elapsed := time.Since(start); elapsed < (1<<maxReadFailures-1)*time.Millisecond {
+		t.Errorf("retries took %s", elapsed)
+	}
+	err := retry.failed(ctx, fake.Config(), "/data/", []*Queue{queue}, unix.EBADF)
+	if !errors.Is(err, unix.EBADF) {
+		t.Errorf("err = %v, want EBADF", err)
+	}
+
+	retry.succeeded()
+	if err := retry.failed(ctx, fake.Config(), "/data/", []*Queue{queue}, unix.EIO); err != nil {
+		t.Fatal(err)
+	}
+	if _, seq := queue.fullSyncPending(); seq != 2 {
+		t.Errorf("full sync not scheduled again after recovery")
+	}
+}
+
+// 停止时不再等待重试
+func TestReadRetryStops(t *testing.T) {
+	queue, fake := newTestQueue(t, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	retry := readRetry{failures: maxReadFailures - 1}
+	start := time.Now()
+	if err := retry.failed(ctx, fake.Config(), "/data/", []*Queue{queue}, unix.EBADF); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited %s after stop", elapsed)
+	}
+}
+
+// 移动的两端分别按排除规则和监听范围判断是否需要同步
+func TestOfferMoveScope(t *testing.T) {
+	tests := []struct {
+		name     string
+		includes []string
+		from, to string
+		want     []string
+	}{
+		{"both in scope", []string{"logs/"}, "logs/a", "logs/b", []string{"RENAME logs/a -> logs/b"}},
+		{"whole tree", nil, "tmp/a", "logs/b", []string{"RENAME tmp/a -> logs/b"}},
+		{"moved into scope", []string{"logs/"}, "tmp/a", "logs/a", []string{"CREATE logs/a"}},
+		{"moved out of scope", []string{"logs/"}, "logs/a", "tmp/a", []string{"DELETE logs/a"}},
+		{"outside scope", []string{"logs/"}, "tmp/a", "tmp/b", []string{}},
+		{"folder moved into scope", []string{"logs/2024/"}, "tmp/", "logs/2024/", []string{"CREATE logs/2024/"}},
+		{"moved out of watch folder", []string{"logs/"}, "logs/a", "", []string{"DELETE logs/a"}},
+		{"moved out from outside scope", []string{"logs/"}, "tmp/a", "", []string{}},
+		{"moved in from excluded", []string{"logs/"}, "logs/a.tmp", "logs/a", []string{"CREATE logs/a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue, fake := newTestQueue(t, 1)
+			config := *fake.Config()
+			config.Excludes = []string{"**/*.tmp"}
+			offerMove(&config, test.includes, []*Queue{queue}, test.from, test.to)
+			if got := actionStrs(queue.actions); strings.Join(got, "; ") != strings.Join(test.want, "; ") {
+				t.Errorf("actions = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package watcher
+
+import (
+	"gosync/internal/metrics"
+	"gosync/internal/tree"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_CREATE | unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ATTRIB
+
+// inotify监听表，维护 watch descriptor (wd) 与目录相对路径的双向映射
+type watchTable struct {
+	fd       int
+	name     string
+	root     string
+	symlinks string
+	wdToPath map[int]string
+	pathToWd map[string]int
+}
+
+func newWatchTable(fd int, name string, root string, symlinks string) *watchTable {
+	return &watchTable{
+		fd:       fd,
+		name:     name,
+		root:     root,
+		symlinks: symlinks,
+		wdToPath: map[int]string{},
+		pathToWd: map[string]int{},
+	}
+}
+
+func (table *watchTable) path(wd int) (string, bool) {
+	path, ok := table.wdToPath[wd]
+	return path, ok
+}
+
+func (table *watchTable) watched(dir string) bool {
+	_, ok := table.pathToWd[dir]
+	return ok
+}
+
+// 递归添加目录及其子目录到 inotify 监听列表，并记录 wd 到路径的映射
+func (table *watchTable) add(includes []string, excludes []string, dir string) error {
+	defer table.updateCount()
+	return tree.Walk(table.root, dir, table.symlinks, func(relPath string, info fs.FileInfo, err error) (bool, error) {
+		if err != nil {
+			// 子路径在遍历过程中被删除或者是失效的链接
+			if relPath != dir {
+				logrus.Debugf("Scan %s error: %s", relPath, err.Error())
+				return false, nil
+			}
+			return false, err
+		}
+		// 只对目录添加监听
+		if !info.IsDir() {
+			return false, nil
+		}
+		if relPath == "" {
+			relPath = "./"
+		}
+		if tree.ShouldWatch(includes, relPath) && !tree.Excluded(excludes, relPath) {
+			wd, err := unix.InotifyAddWatch(table.fd, table.root+relPath, watchMask)
+			if err != nil {
+				logrus.WithError(err).Errorf("Cannot watch folder: %s", relPath)
+				return false, err
+			}
+			// 记录 wd 到目录路径的映射，同一目录重复添加时返回相同的wd
+			if old, ok := table.wdToPath[wd]; ok && old != relPath {
+				// 通过符号链接从多个路径到达同一个目录时只监听最先添加的路径
+				if table.symlinks == "follow" && sameFile(table.root+old, table.root+relPath) {
+					logrus.Warnf("Folder %s is already watched as %s, skip it.", relPath, old)
+					return false, nil
+				}
+				delete(table.pathToWd, old)
+			}
+			table.wdToPath[wd] = relPath
+			table.pathToWd[relPath] = wd
+			logrus.Debugf("Watch folder: %s (wd: %d)", relPath, wd)
+		}
+		return true, nil
+	})
+}
+
+func sameFile(a string, b string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
+
+// 移除目录及其子目录的监听
+func (table *watchTable) remove(dir string) {
+	defer table.updateCount()
+	for path, wd := range table.pathToWd {
+		if strings.HasPrefix(path, dir) {
+			unix.InotifyRmWatch(table.fd, uint32(wd))
+			table.forget(wd)
+			logrus.Debugf("Unwatch folder: %s (wd: %d)", path, wd)
+		}
+	}
+}
+
+// 内核已经移除了监听(IN_IGNORED)，清理映射
+func (table *watchTable) forget(wd int) {
+	path, ok := table.wdToPath[wd]
+	if !ok {
+		return
+	}
+	delete(table.wdToPath, wd)
+	if table.pathToWd[path] == wd {
+		delete(table.pathToWd, path)
+	}
+	table.updateCount()
+}
+
+func (table *watchTable) updateCount() {
+	metrics.Watches.Set(float64(len(table.wdToPath)), table.name)
+}
+
+// 目录在监听范围内移动后，监听仍然有效，只需要更新目录及其子目录的路径
+func (table *watchTable) move(from string, to string) {
+	moved := map[string]int{}
+	for path, wd := range table.pathToWd {
+		if strings.HasPrefix(path, from) {
+			moved[to+path[len(from):]] = wd
+			delete(table.pathToWd, path)
+		}
+	}
+	for path, wd := range moved {
+		table.pathToWd[path] = wd
+		table.wdToPath[wd] = path
+		logrus.Debugf("Watch folder: %s (wd: %d, moved)", path, wd)
+	}
+}
@@ -0,0 +1,230 @@
+package watcher
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// 两个方向的映射必须一致
+func checkMappings(t *testing.T, table *watchTable) {
+	t.Helper()
+	if len(table.wdToPath) != len(table.pathToWd) {
+		t.Errorf("wdToPath = %v, pathToWd = %v", table.wdToPath, table.pathToWd)
+	}
+	for path, wd := range table.pathToWd {
+		if table.wdToPath[wd] != path {
+			t.Errorf("wd %d of %s maps to %q", wd, path, table.wdToPath[wd])
+		}
+	}
+}
+
+func TestWatchTableMappings(t *testing.T) {
+	initial := map[string]int{"./": 1, "a/": 2, "a/b/": 3, "a/b/c/": 4, "ab/": 5}
+	tests := []struct {
+		name string
+		ops  func(table *watchTable)
+		want map[string]int
+	}{
+		{
+			name: "move nested folder",
+			ops:  func(table *watchTable) { table.move("a/b/", "x/b/") },
+			want: map[string]int{"./": 1, "a/": 2, "x/b/": 3, "x/b/c/": 4, "ab/": 5},
+		},
+		{
+			name: "move keeps sibling with same prefix",
+			ops:  func(table *watchTable) { table.move("a/", "z/a/") },
+			want: map[string]int{"./": 1, "z/a/": 2, "z/a/b/": 3, "z/a/b/c/": 4, "ab/": 5},
+		},
+		{
+			name: "move back",
+			ops: func(table *watchTable) {
+				table.move("a/b/", "b/")
+				table.move("b/", "a/b/")
+			},
+			want: initial,
+		},
+		{
+			name: "forget on IN_IGNORED",
+			ops:  func(table *watchTable) { table.forget(3) },
+			want: map[string]int{"./": 1, "a/": 2, "a/b/c/": 4, "ab/": 5},
+		},
+		{
+			name: "forget after move",
+			ops: func(table *watchTable) {
+				table.move("a/b/", "x/")
+				table.forget(4)
+			},
+			want: map[string]int{"./": 1, "a/": 2, "x/": 3, "ab/": 5},
+		},
+		{
+			name: "forget unknown wd",
+			ops:  func(table *watchTable) { table.forget(9) },
+			want: initial,
+		},
+		{
+			name: "forget stale wd of re-added folder",
+			ops: func(table *watchTable) {
+				// 移除后重新添加得到新的wd，之后才收到旧wd的IN_IGNORED
+				table.forget(3)
+				table.wdToPath[3] = "a/b/"
+				table.wdToPath[6] = "a/b/"
+				table.pathToWd["a/b/"] = 6
+				table.forget(3)
+			},
+			want: map[string]int{"./": 1, "a/": 2, "a/b/": 6, "a/b/c/": 4, "ab/": 5},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table := newWatchTable(-1, "test", "/nonexistent/", "skip")
+			for path, wd := range initial {
+				table.wdToPath[wd] = path
+				table.pathToWd[path] = wd
+			}
+			test.ops(table)
+			if !reflect.DeepEqual(table.pathToWd, test.want) {
+				t.Errorf("pathToWd = %v, want %v", table.pathToWd, test.want)
+			}
+			checkMappings(t, table)
+		})
+	}
+}
+
+type inotifyEvent struct {
+	wd   int
+	mask uint32
+	name string
+}
+
+// 读取timeout内收到的inotify事件，直到满足done
+func readEvents(t *testing.T, fd int, done func([]inotifyEvent) bool) []inotifyEvent {
+	t.Helper()
+	events := []inotifyEvent{}
+	buf := make([]byte, 4096)
+	deadline := time.Now().Add(2 * time.Second)
+	for !done(events) {
+		if time.Now().After(deadline) {
+			t.Fatalf("events not received: %+v", events)
+		}
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		if n, _ := unix.Poll(fds, 100); n <= 0 {
+			continue
+		}
+		n, err := unix.Read(fd, buf)
+		if err != nil {
+			continue
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name := strings.TrimRight(string(buf[offset+unix.SizeofInotifyEvent:offset+unix.SizeofInotifyEvent+int(raw.Len)]), "\x00")
+			events = append(events, inotifyEvent{wd: int(raw.Wd), mask: raw.Mask, name: name})
+			offset += unix.SizeofInotifyEvent + int(raw.Len)
+		}
+	}
+	return events
+}
+
+// 在真实的目录树上验证移动、删除和重新添加后事件仍能映射到正确的路径
+func TestWatchTableInotify(t *testing.T) {
+	root := t.TempDir() + "/"
+	for _, dir := range []string{"a/b/c", "x"} {
+		if err := os.MkdirAll(root+dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		t.Skip("inotify not available:", err)
+	}
+	defer unix.Close(fd)
+	table := newWatchTable(fd, "test", root, "skip")
+	if err := table.add(nil, []string{"x/"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"./", "a/", "a/b/", "a/b/c/"} {
+		if !table.watched(dir) {
+			t.Errorf("%s not watched", dir)
+		}
+	}
+	if table.watched("x/") {
+		t.Error("excluded x/ watched")
+	}
+	checkMappings(t, table)
+
+	// 嵌套的目录移动后原有的监听继续有效
+	wdB, wdC := table.pathToWd["a/b/"], table.pathToWd["a/b/c/"]
+	if err := os.Rename(root+"a/b", root+"moved"); err != nil {
+		t.Fatal(err)
+	}
+	table.move("a/b/", "moved/")
+	if table.pathToWd["moved/"] != wdB || table.pathToWd["moved/c/"] != wdC || table.watched("a/b/") {
+		t.Fatalf("pathToWd after move = %v", table.pathToWd)
+	}
+	checkMappings(t, table)
+	if err := os.WriteFile(root+"moved/c/file", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	readEvents(t, fd, func(events []inotifyEvent) bool {
+		for _, event := range events {
+			if path, ok := table.path(event.wd); ok && path == "moved/c/" && event.name == "file" {
+				return true
+			}
+		}
+		return false
+	})
+
+	// 删除目录后内核发送IN_IGNORED，映射随之清理
+	if err := os.RemoveAll(root + "moved"); err != nil {
+		t.Fatal(err)
+	}
+	ignored := map[int]bool{}
+	readEvents(t, fd, func(events []inotifyEvent) bool {
+		for _, event := range events {
+			if event.mask&unix.IN_IGNORED != 0 && !ignored[event.wd] {
+				ignored[event.wd] = true
+				table.forget(event.wd)
+			}
+		}
+		return ignored[wdB] && ignored[wdC]
+	})
+	if table.watched("moved/") || table.watched("moved/c/") {
+		t.Errorf("pathToWd after delete = %v", table.pathToWd)
+	}
+	checkMappings(t, table)
+
+	// 移除后重新添加
+	wdA := table.pathToWd["a/"]
+	table.remove("a/")
+	if table.watched("a/") {
+		t.Fatal("a/ still watched after remove")
+	}
+	if err := table.add(nil, nil, "a/"); err != nil {
+		t.Fatal(err)
+	}
+	if !table.watched("a/") {
+		t.Fatal("a/ not watched after add")
+	}
+	checkMappings(t, table)
+	// 旧wd的IN_IGNORED在重新添加之后到达，不能影响新的监听
+	table.forget(wdA)
+	if !table.watched("a/") {
+		t.Fatal("a/ unwatched by stale IN_IGNORED")
+	}
+	if err := os.WriteFile(root+"a/file", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	readEvents(t, fd, func(events []inotifyEvent) bool {
+		for _, event := range events {
+			if path, ok := table.path(event.wd); ok && path == "a/" && event.name == "file" {
+				return true
+			}
+		}
+		return false
+	})
+}
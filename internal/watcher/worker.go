@@ -0,0 +1,184 @@
+package watcher
+
+import (
+	"context"
+	"gosync/internal/dest"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+type task struct {
+	id      int
+	client  dest.Destination
+	actions []Action
+}
+
+type result struct {
+	id      int
+	actions []Action
+	failed  []Action
+	err     error
+}
+
+// 同步线程，每个任务中的动作类型相同，同步、属性同步和删除合并为一次rsync调用执行，重命名逐个执行
+func (queue *Queue) work(ctx context.Context, tasks <-chan task, results chan<- result) {
+	for t := range tasks {
+		client := t.client
+		paths := make([]string, len(t.actions))
+		for i, action := range t.actions {
+			paths[i] = action.Path
+		}
+		var res dest.Result
+		if t.actions[0].Method == RENAME {
+			for _, action := range t.actions {
+				logrus.Infof("Starting rename %s -> %s ... (%s)", action.From, action.Path, client.Name())
+				if err := client.Rename(ctx, action.From, action.Path); err != nil {
+					res.Fail(action.Path, err)
+				}
+			}
+		} else if t.actions[0].Method == ATTRIB {
+			logrus.Infof("Starting sync attributes of %d paths: %s ... (%s)", len(paths), strings.Join(paths, ", "), client.Name())
+			res = client.SyncAttrs(ctx, paths)
+		} else if t.actions[0].Method == DELETE {
+			logrus.Infof("Starting delete %d paths: %s ... (%s)", len(paths), strings.Join(paths, ", "), client.Name())
+			res = client.DeleteFiles(ctx, paths)
+		} else {
+			logrus.Infof("Starting sync %d paths: %s ... (%s)", len(paths), strings.Join(paths, ", "), client.Name())
+			res = client.SyncFiles(ctx, paths)
+		}
+		failures := map[string]bool{}
+		for _, path := range res.Failed {
+			failures[path] = true
+		}
+		r := result{id: t.id, actions: t.actions, err: res.Err}
+		succeeded := []Action{}
+		for _, action := range t.actions {
+			if failures[action.Path] {
+				r.failed = append(r.failed, action)
+			} else {
+				succeeded = append(succeeded, action)
+			}
+		}
+		queue.record(client, succeeded)
+		results <- r
+	}
+}
+
+// 从队列中挑选可以并行执行的任务，最多分成workers批。
+// 同一路径或存在上下级关系的路径必须按顺序执行：与正在执行的任务或前面未能执行的任务相关的动作需要等待，
+// 相关的同类动作放在同一批中执行，不同类的则等待前一个完成。
+func schedule(actions []Action, running []Action, workers int) ([][]Action, []Action) {
+	groups := [][]Action{}
+	groupOf := make([]int, len(actions))
+	for i, action := range actions {
+		groupOf[i] = -1
+		blocked := false
+		for _, r := range running {
+			if related(r, action) {
+				blocked = true
+				break
+			}
+		}
+		group := -1
+		for j := 0; j < i && !blocked; j++ {
+			if !related(actions[j], action) {
+				continue
+			}
+			if groupOf[j] < 0 || kind(actions[j]) != kind(action) || (group >= 0 && group != groupOf[j]) {
+				blocked = true
+			} else {
+				group = groupOf[j]
+			}
+		}
+		if blocked {
+			continue
+		}
+		if group < 0 {
+			group = len(groups)
+			groups = append(groups, nil)
+		}
+		groupOf[i] = group
+		groups[group] = append(groups[group], action)
+	}
+
+	// 将相互独立的分组分配到不同的批次，同一批次中的动作类型必须相同
+	batches := [][]Action{}
+	batchOf := make([]int, len(groups))
+	for g, group := range groups {
+		batchOf[g] = -1
+		if len(batches) < workers {
+			batchOf[g] = len(batches)
+			batches = append(batches, group)
+			continue
+		}
+		for b, batch := range batches {
+			if kind(batch[0]) == kind(group[0]) && (batchOf[g] < 0 || len(batch) < len(batches[batchOf[g]])) {
+				batchOf[g] = b
+			}
+		}
+		if batchOf[g] >= 0 {
+			batches[batchOf[g]] = append(batches[batchOf[g]], group...)
+		}
+	}
+
+	// 批次内保持动作的原有顺序
+	for _, batch := range batches {
+		sort.Slice(batch, func(i, j int) bool {
+			return batch[i].id < batch[j].id
+		})
+	}
+	rest := []Action{}
+	for i, action := range actions {
+		if groupOf[i] < 0 || batchOf[groupOf[i]] < 0 {
+			rest = append(rest, action)
+		}
+	}
+	return batches, rest
+}
+
+// 按入队顺序合并两组动作
+func merge(actions []Action, others []Action) []Action {
+	out := make([]Action, 0, len(actions)+len(others))
+	i, j := 0, 0
+	for i < len(actions) || j < len(others) {
+		if j >= len(others) || (i < len(actions) && actions[i].id <= others[j].id) {
+			out = append(out, actions[i])
+			i++
+		} else {
+			out = append(out, others[j])
+			j++
+		}
+	}
+	return out
+}
+
+// 动作的类型，同类的动作才能合并到一批执行
+func kind(action Action) int {
+	if action.Method == CREATE {
+		return WRITE
+	}
+	return action.Method
+}
+
+// 两个动作涉及的路径相同或存在上下级关系，重命名同时涉及原路径和新路径
+func related(a Action, b Action) bool {
+	if overlaps(a.Path, b.Path) {
+		return true
+	}
+	if a.From != "" && overlaps(a.From, b.Path) {
+		return true
+	}
+	if b.From != "" && (overlaps(a.Path, b.From) || (a.From != "" && overlaps(a.From, b.From))) {
+		return true
+	}
+	return false
+}
+
+// 两个路径相同或存在上下级关系
+func overlaps(a string, b string) bool {
+	a = strings.TrimSuffix(a, "/")
+	b = strings.TrimSuffix(b, "/")
+	return a == b || strings.HasPrefix(b, a+"/") || strings.HasPrefix(a, b+"/")
+}